@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/gob"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// reconnection attempts to a peer back off exponentially from minBackoff up
+	// to maxBackoff; peers that we have failed to reach too many times in a row
+	// and haven't seen for a long time are forgotten entirely
+	minBackoff    = 5 * time.Second
+	maxBackoff    = 5 * time.Minute
+	forgetAfter   = 10
+	forgetUnseen  = 24 * time.Hour
+	maxBookLength = 1000
+)
+
+type AddrEntry struct {
+	Addr     string
+	LastSeen time.Time // zero if we've heard of the peer but never connected
+	Failures int       // consecutive failed connection attempts
+	NextTry  time.Time
+	Identity string // fingerprint of the peer's identity key, if using encryption
+}
+
+// AddrBook remembers the addresses of peers we know about, optionally persisting
+// them to a file so that a restarted node can find its way back into the network
+type AddrBook struct {
+	path    string // empty if the book is only kept in memory
+	entries map[string]*AddrEntry
+	lock    sync.Mutex
+}
+
+func LoadAddrBook(path string) (*AddrBook, error) {
+	book := &AddrBook{path: path, entries: make(map[string]*AddrEntry)}
+
+	if path == "" {
+		return book, nil
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return book, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []*AddrEntry
+	err = gob.NewDecoder(file).Decode(&entries)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		// whatever backoff we were in when we last ran is no longer relevant
+		entry.NextTry = time.Time{}
+		book.entries[entry.Addr] = entry
+	}
+
+	return book, nil
+}
+
+//
+// public, locked functions
+//
+
+// records that addr is a peer, without saying anything about whether it is reachable
+func (book *AddrBook) Add(addr string) {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	if book.entries[addr] == nil && len(book.entries) < maxBookLength {
+		book.entries[addr] = &AddrEntry{Addr: addr}
+	}
+}
+
+// records that we are currently connected to each of addrs
+func (book *AddrBook) Seen(addrs ...string) {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	now := time.Now()
+	for _, addr := range addrs {
+		entry := book.entries[addr]
+		if entry == nil {
+			entry = &AddrEntry{Addr: addr}
+			book.entries[addr] = entry
+		}
+		entry.LastSeen = now
+		entry.Failures = 0
+		entry.NextTry = time.Time{}
+	}
+
+	book.save()
+}
+
+func (book *AddrBook) Remove(addr string) {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	if book.entries[addr] != nil {
+		delete(book.entries, addr)
+		book.save()
+	}
+}
+
+// records a failed attempt to connect to addr
+func (book *AddrBook) Failed(addr string) {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	entry := book.entries[addr]
+	if entry == nil {
+		return
+	}
+
+	entry.Failures++
+	if entry.Failures >= forgetAfter && time.Since(entry.LastSeen) > forgetUnseen {
+		delete(book.entries, addr)
+	} else {
+		backoff := minBackoff << uint(entry.Failures-1)
+		if backoff > maxBackoff || backoff <= 0 {
+			backoff = maxBackoff
+		}
+		entry.NextTry = time.Now().Add(backoff)
+	}
+
+	book.save()
+}
+
+// checks that identity matches the one we've seen before for addr, or pins it
+// if we haven't; returns false if a different identity has already been pinned
+func (book *AddrBook) Pin(addr, identity string) bool {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	entry := book.entries[addr]
+	if entry == nil {
+		if len(book.entries) >= maxBookLength {
+			return true // can't remember it, so nothing to check against
+		}
+		entry = &AddrEntry{Addr: addr}
+		book.entries[addr] = entry
+	}
+
+	if entry.Identity == "" {
+		entry.Identity = identity
+		book.save()
+		return true
+	}
+
+	return entry.Identity == identity
+}
+
+// returns false if an identity other than the given one has been pinned for addr.
+// Unlike Pin it never pins anything, so it is safe to use with an address the
+// peer claims for itself
+func (book *AddrBook) Matches(addr, identity string) bool {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	entry := book.entries[addr]
+	return entry == nil || entry.Identity == "" || entry.Identity == identity
+}
+
+// replaces from with to, which we've learned is where the peer really listens,
+// keeping any identity pinned for from; returns false, changing nothing, if a
+// different identity has already been pinned for to
+func (book *AddrBook) Move(from, to string) bool {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	entry := book.entries[from]
+	if entry == nil {
+		return true
+	}
+
+	target := book.entries[to]
+	if target == nil {
+		target = &AddrEntry{Addr: to}
+		book.entries[to] = target
+	} else if target.Identity != "" && entry.Identity != "" && target.Identity != entry.Identity {
+		return false
+	}
+	if target.Identity == "" {
+		target.Identity = entry.Identity
+	}
+	delete(book.entries, from)
+
+	book.save()
+	return true
+}
+
+// returns the addresses that are due a connection attempt, most recently seen first
+func (book *AddrBook) Candidates() []string {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	now := time.Now()
+	var due []*AddrEntry
+	for _, entry := range book.entries {
+		if !entry.NextTry.After(now) {
+			due = append(due, entry)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].LastSeen.After(due[j].LastSeen)
+	})
+
+	addrs := make([]string, len(due))
+	for i, entry := range due {
+		addrs[i] = entry.Addr
+	}
+	return addrs
+}
+
+func (book *AddrBook) Entries() []AddrEntry {
+	book.lock.Lock()
+	defer book.lock.Unlock()
+
+	entries := make([]AddrEntry, 0, len(book.entries))
+	for _, entry := range book.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Addr < entries[j].Addr
+	})
+	return entries
+}
+
+//
+// private, unlocked functions *must* be called while already holding the lock
+//
+
+func (book *AddrBook) save() {
+	if book.path == "" {
+		return
+	}
+
+	entries := make([]*AddrEntry, 0, len(book.entries))
+	for _, entry := range book.entries {
+		entries = append(entries, entry)
+	}
+
+	// write to a temporary file and rename it into place, so a crash (or another
+	// gocoin process sharing the file) can never leave it half-written
+	tmp := book.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		logger.Println("Failed to save address book:", err)
+		return
+	}
+
+	err = gob.NewEncoder(file).Encode(entries)
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmp, book.path)
+	}
+	if err != nil {
+		logger.Println("Failed to save address book:", err)
+		os.Remove(tmp)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAddrBookMove(t *testing.T) {
+	book, _ := LoadAddrBook("")
+	book.Pin("dialed", "alice")
+	if !book.Move("dialed", "listening") {
+		t.Fatal("couldn't move to a new address")
+	}
+	if !book.Matches("listening", "alice") || book.Matches("listening", "mallory") {
+		t.Error("pinned identity didn't move with the address")
+	}
+	if entries := book.Entries(); len(entries) != 1 || entries[0].Addr != "listening" {
+		t.Errorf("got entries %v, want just the new address", entries)
+	}
+
+	book.Pin("other", "bob")
+	if book.Move("other", "listening") {
+		t.Error("moved over an address pinned to someone else")
+	}
+	if !book.Matches("other", "bob") || !book.Matches("listening", "alice") {
+		t.Error("failed move changed the pinned identities")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// an Address is what coins are paid to: a hash of the public key that can spend
+// them, so that the key itself only has to be revealed when the coins are spent.
+// For display addresses are encoded Base58Check style, as a version byte followed
+// by the hash and a checksum, which catches typos when an address is copied by
+// hand. The version byte makes every address start with a "G"
+type Address [addressLength]byte
+
+const (
+	addressLength   = 20
+	addressVersion  = 38
+	addressChecksum = 4
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+var (
+	errAddressFormat   = errors.New("Invalid address: bad characters or length")
+	errAddressVersion  = errors.New("Invalid address: not a gocoin address")
+	errAddressChecksum = errors.New("Invalid address: checksum mismatch (typo?)")
+)
+
+// the key's scheme is hashed along with it, so the same bytes used as a key of
+// another scheme make a different address
+func AddressOf(key *PublicKey) Address {
+	var addr Address
+	copy(addr[:], doubleHash(append([]byte{byte(key.Scheme)}, key.Data...)))
+	return addr
+}
+
+func (addr Address) String() string {
+	payload := append([]byte{addressVersion}, addr[:]...)
+	payload = append(payload, doubleHash(payload)[:addressChecksum]...)
+	return base58Encode(payload)
+}
+
+// parses and validates the string form of an address
+func ParseAddress(s string) (Address, error) {
+	var addr Address
+
+	payload, ok := base58Decode(s)
+	if !ok || len(payload) != 1+addressLength+addressChecksum {
+		return addr, errAddressFormat
+	}
+	if payload[0] != addressVersion {
+		return addr, errAddressVersion
+	}
+
+	body, checksum := payload[:1+addressLength], payload[1+addressLength:]
+	if !bytes.Equal(doubleHash(body)[:addressChecksum], checksum) {
+		return addr, errAddressChecksum
+	}
+
+	copy(addr[:], body[1:])
+	return addr, nil
+}
+
+func ValidAddress(s string) bool {
+	_, err := ParseAddress(s)
+	return err == nil
+}
+
+func doubleHash(data []byte) []byte {
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+// leading zero bytes are encoded as leading '1's, since they wouldn't otherwise
+// change the number
+func base58Encode(data []byte) string {
+	n := new(big.Int).SetBytes(data)
+	base := big.NewInt(int64(len(base58Alphabet)))
+	mod := new(big.Int)
+
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, base, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func base58Decode(s string) ([]byte, bool) {
+	n := new(big.Int)
+	base := big.NewInt(int64(len(base58Alphabet)))
+
+	zeros := 0
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+
+	for i := 0; i < len(s); i++ {
+		digit := bytes.IndexByte([]byte(base58Alphabet), s[i])
+		if digit < 0 {
+			return nil, false
+		}
+		n.Mul(n, base)
+		n.Add(n, big.NewInt(int64(digit)))
+	}
+
+	return append(make([]byte, zeros), n.Bytes()...), true
+}
@@ -5,6 +5,14 @@ import (
 	"encoding/gob"
 )
 
+// limits on what a valid block may contain, so that blocks stay quick to send
+// and to check. each input of each transaction costs one signature check
+const (
+	maxBlockBytes     = 256 << 10
+	maxBlockTxns      = 1000
+	maxBlockSigChecks = 2000
+)
+
 type Block struct {
 	PrevHash []byte
 	Nonce    uint32
@@ -26,3 +34,22 @@ func (b *Block) Verify() bool {
 	// first 17 bits zero? timed for 5-20 seconds per solve on modern CPU
 	return hash[0] == 0 && hash[1] == 0 && hash[2]&0x80 == 0
 }
+
+// the number of bytes the block takes up when encoded
+func (b *Block) Size() int {
+	var counter byteCounter
+	err := gob.NewEncoder(&counter).Encode(b)
+	if err != nil {
+		panic(err)
+	}
+	return int(counter)
+}
+
+// the number of signatures that have to be checked to validate the block
+func (b *Block) SigChecks() int {
+	var checks int
+	for _, txn := range b.Txns {
+		checks += len(txn.Inputs)
+	}
+	return checks
+}
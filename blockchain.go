@@ -21,14 +21,74 @@ func (chain *BlockChain) Last() *Block {
 	return chain.Blocks[len(chain.Blocks)-1]
 }
 
+func (chain *BlockChain) Contains(hash []byte) bool {
+	return chain.Find(hash) >= 0
+}
+
+// returns the index of the block with the given hash, or -1 if there isn't one
+func (chain *BlockChain) Find(hash []byte) int {
+	// search backwards, since we usually care about recent blocks
+	for i := len(chain.Blocks) - 1; i >= 0; i-- {
+		if bytes.Equal(chain.Blocks[i].Hash(), hash) {
+			return i
+		}
+	}
+	return -1
+}
+
+// returns a new chain made up of the first n blocks of this one, for building
+// a fork on, or nil if those blocks aren't valid
+func (chain *BlockChain) Fork(n int) *BlockChain {
+	fork := NewBlockChain()
+	for _, blk := range chain.Blocks[:n] {
+		if !fork.Append(blk) {
+			return nil
+		}
+	}
+	return fork
+}
+
 func (chain *BlockChain) Append(blk *Block) bool {
+	// the first transaction (and only the first) pays the miner, who gets
+	// the fees paid by all the others in addition to the usual amount
+	if len(blk.Txns) == 0 || !blk.Txns[0].IsMiner() {
+		return false
+	}
+
+	if len(blk.Txns) > maxBlockTxns || blk.SigChecks() > maxBlockSigChecks {
+		logger.Println("Block has too many txns!", len(blk.Txns), blk.SigChecks())
+		return false
+	}
+	if size := blk.Size(); size > maxBlockBytes {
+		logger.Println("Block too large!", size)
+		return false
+	}
+
 	tmpKeys := chain.Keys.Copy()
-	for _, txn := range blk.Txns {
+	var fees uint64
+	for i, txn := range blk.Txns {
+		if i > 0 {
+			fee, ok := tmpKeys.Fee(txn)
+			if !ok || txn.IsMiner() {
+				return false
+			}
+			if fees, ok = addAmounts(fees, fee); !ok {
+				logger.Println("Block fees overflow!")
+				return false
+			}
+		}
 		if !tmpKeys.AddTxn(txn) {
 			return false
 		}
 	}
 
+	reward, ok := addAmounts(miningAmount, fees)
+	claimed, claimedOk := blk.Txns[0].CheckedTotal()
+	if !ok || !claimedOk || claimed > reward {
+		logger.Println("Miner claimed too much!", claimed, reward)
+		return false
+	}
+
 	chain.Blocks = append(chain.Blocks, blk)
 	chain.Keys = tmpKeys
 	return true
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Coin is the coins held at one address in our wallet
+type Coin struct {
+	Address Address
+	Amount  uint64
+}
+
+// CoinSelector decides which of our coins to spend to pay (at least) target,
+// returning nil if they don't add up to enough. Anything selected over the
+// target comes back to us as change
+type CoinSelector interface {
+	Select(coins []Coin, target uint64) []Coin
+}
+
+var coinSelectors = map[string]CoinSelector{
+	"largest":  LargestFirst{},
+	"smallest": SmallestFirst{},
+	"bnb":      BranchAndBound{},
+	"privacy":  PrivacyFirst{},
+}
+
+const defaultCoinSelector = "bnb"
+
+// how many combinations BranchAndBound tries before giving up on an exact match
+const bnbMaxTries = 100000
+
+// returns a copy of coins sorted largest first; ties are broken by address, so
+// that the same wallet always gives the same selection
+func sortedCoins(coins []Coin, largestFirst bool) []Coin {
+	sorted := append([]Coin(nil), coins...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Amount != sorted[j].Amount {
+			return (sorted[i].Amount > sorted[j].Amount) == largestFirst
+		}
+		return bytes.Compare(sorted[i].Address[:], sorted[j].Address[:]) < 0
+	})
+	return sorted
+}
+
+// takes coins in the given order until they cover target
+func takeUntil(coins []Coin, target uint64) []Coin {
+	var total uint64
+	for i, coin := range coins {
+		total += coin.Amount
+		if total >= target {
+			return coins[:i+1]
+		}
+	}
+	return nil
+}
+
+// LargestFirst spends as few coins as possible, which keeps txns small (and so
+// their fees low) but tends to leave the wallet full of little coins
+type LargestFirst struct{}
+
+func (LargestFirst) Select(coins []Coin, target uint64) []Coin {
+	return takeUntil(sortedCoins(coins, true), target)
+}
+
+// SmallestFirst tidies up the wallet by spending its little coins, at the cost
+// of bigger txns
+type SmallestFirst struct{}
+
+func (SmallestFirst) Select(coins []Coin, target uint64) []Coin {
+	return takeUntil(sortedCoins(coins, false), target)
+}
+
+// BranchAndBound searches for coins adding up to exactly target, so that there's
+// no change (which saves an output, and doesn't hand observers a link between
+// the payment and our change address). If there is no exact match (or it takes
+// too long to find one) it falls back to LargestFirst
+type BranchAndBound struct{}
+
+func (BranchAndBound) Select(coins []Coin, target uint64) []Coin {
+	sorted := sortedCoins(coins, true)
+
+	// remaining[i] is the total of sorted[i:], so we can stop exploring a branch
+	// as soon as it can't possibly reach the target
+	remaining := make([]uint64, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].Amount
+	}
+	if remaining[0] < target {
+		return nil
+	}
+
+	var picked []Coin
+	tries := 0
+
+	// depth first, trying to include each coin before trying without it
+	var search func(i int, total uint64) bool
+	search = func(i int, total uint64) bool {
+		tries++
+		if total == target {
+			return true
+		}
+		if i == len(sorted) || total > target || total+remaining[i] < target || tries > bnbMaxTries {
+			return false
+		}
+
+		picked = append(picked, sorted[i])
+		if search(i+1, total+sorted[i].Amount) {
+			return true
+		}
+		picked = picked[:len(picked)-1]
+		return search(i+1, total)
+	}
+
+	if search(0, 0) {
+		return picked
+	}
+	return LargestFirst{}.Select(coins, target)
+}
+
+// PrivacyFirst avoids linking our addresses together: every address spent from
+// in the same txn is obviously owned by the same person. It uses the smallest
+// single coin that covers the target if there is one, and otherwise as few
+// coins as possible
+type PrivacyFirst struct{}
+
+func (PrivacyFirst) Select(coins []Coin, target uint64) []Coin {
+	sorted := sortedCoins(coins, false)
+	for _, coin := range sorted {
+		if coin.Amount >= target {
+			return []Coin{coin}
+		}
+	}
+	return LargestFirst{}.Select(coins, target)
+}
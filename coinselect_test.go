@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testAddress(b byte) Address {
+	var addr Address
+	addr[0] = b
+	return addr
+}
+
+// deliberately unsorted, with a tie between two coins of 20
+var testCoins = []Coin{
+	{testAddress(1), 20},
+	{testAddress(2), 5},
+	{testAddress(3), 50},
+	{testAddress(4), 1},
+	{testAddress(5), 20},
+	{testAddress(6), 10},
+}
+
+// returns the testCoins at the given indexes, or nil if there are none
+func pickCoins(indexes ...int) []Coin {
+	var coins []Coin
+	for _, i := range indexes {
+		coins = append(coins, testCoins[i])
+	}
+	return coins
+}
+
+func TestCoinSelectors(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector CoinSelector
+		target   uint64
+		want     []Coin
+	}{
+		{"largest, one coin", LargestFirst{}, 30, pickCoins(2)},
+		{"largest, two coins", LargestFirst{}, 60, pickCoins(2, 0)},
+		{"largest, everything", LargestFirst{}, 106, pickCoins(2, 0, 4, 5, 1, 3)},
+		{"largest, insufficient", LargestFirst{}, 107, nil},
+
+		{"smallest, two coins", SmallestFirst{}, 6, pickCoins(3, 1)},
+		{"smallest, ties by address", SmallestFirst{}, 30, pickCoins(3, 1, 5, 0)},
+		{"smallest, insufficient", SmallestFirst{}, 107, nil},
+
+		{"bnb, exact match", BranchAndBound{}, 26, pickCoins(0, 1, 3)},
+		{"bnb, another exact match", BranchAndBound{}, 35, pickCoins(0, 5, 1)},
+		{"bnb, no exact match", BranchAndBound{}, 4, pickCoins(2)},
+		{"bnb, insufficient", BranchAndBound{}, 107, nil},
+
+		{"privacy, single coin", PrivacyFirst{}, 15, pickCoins(0)},
+		{"privacy, smallest single coin", PrivacyFirst{}, 2, pickCoins(1)},
+		{"privacy, no single coin", PrivacyFirst{}, 60, pickCoins(2, 0)},
+		{"privacy, insufficient", PrivacyFirst{}, 107, nil},
+	}
+
+	for _, test := range tests {
+		got := test.selector.Select(testCoins, test.target)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: selecting %d got %v, want %v", test.name, test.target, got, test.want)
+		}
+	}
+}
+
+// an exact match exists (twenty 2s) but the search starts by including the 5,
+// under which no subset of the 2s works and there are far too many to try
+func TestBranchAndBoundGivesUp(t *testing.T) {
+	coins := []Coin{{testAddress(0), 5}}
+	for i := 1; i <= 40; i++ {
+		coins = append(coins, Coin{testAddress(byte(i)), 2})
+	}
+
+	got := BranchAndBound{}.Select(coins, 40)
+	want := LargestFirst{}.Select(coins, 40)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d coins, want LargestFirst's %d", len(got), len(want))
+	}
+	if len(want) != 19 {
+		t.Errorf("LargestFirst picked %d coins, want 19", len(want))
+	}
+}
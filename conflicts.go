@@ -0,0 +1,55 @@
+package main
+
+import (
+	"time"
+)
+
+// how many conflicts we remember
+const maxConflicts = 100
+
+type ConflictKind int
+
+const (
+	// a txn was rejected because a pending txn already spends the same coins
+	ConflictRejected ConflictKind = iota
+	// a pending txn was replaced by one spending the same coins for a higher fee
+	ConflictReplaced
+	// a pending txn was dropped because a mined txn spends the same coins
+	ConflictMined
+)
+
+func (kind ConflictKind) String() string {
+	switch kind {
+	case ConflictRejected:
+		return "rejected"
+	case ConflictReplaced:
+		return "replaced"
+	case ConflictMined:
+		return "mined"
+	}
+	return "unknown"
+}
+
+// Conflict records a double-spend: two transactions spending the same coins, only
+// one of which (Kept) can ever be mined
+type Conflict struct {
+	Kind    ConflictKind
+	Kept    *Transaction
+	Dropped *Transaction
+	Spent   []Address // spent from by both
+	Lost    uint64    // coins our wallet was to get from Dropped (or its descendants) but not Kept
+	Time    time.Time
+}
+
+// returns the addresses spent from by both transactions
+func conflictingAddresses(a, b *Transaction) []Address {
+	var addrs []Address
+	for _, x := range a.Inputs {
+		for _, y := range b.Inputs {
+			if keysEql(&x.Key, &y.Key) {
+				addrs = append(addrs, AddressOf(&x.Key))
+			}
+		}
+	}
+	return addrs
+}
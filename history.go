@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+)
+
+// a transaction in the primary chain that pays or spends from an address
+type txnRef struct {
+	Txn    *Transaction
+	Hash   []byte
+	Height int // index of its block in the chain
+	Pos    int // index of the transaction in its block
+}
+
+// AddressIndex records which transactions in the primary chain involve each
+// address, so that the wallet's history can be found without going through the
+// whole chain. It is brought up to date by scanning only the blocks that have
+// changed since last time (after a reorg, the blocks back to where the chains
+// forked). Like Mempool it is owned by State and must only be used while
+// holding State's lock
+type AddressIndex struct {
+	blocks  []*Block
+	hashes  [][]byte
+	touched [][]Address // the addresses each block's transactions involve
+	byAddr  map[Address][]txnRef
+	byHash  map[string]txnRef
+}
+
+func NewAddressIndex() *AddressIndex {
+	return &AddressIndex{
+		byAddr: make(map[Address][]txnRef),
+		byHash: make(map[string]txnRef),
+	}
+}
+
+// returns the number of blocks indexed
+func (index *AddressIndex) Len() int {
+	return len(index.blocks)
+}
+
+// returns the transactions involving addr, oldest first
+func (index *AddressIndex) Refs(addr Address) []txnRef {
+	return index.byAddr[addr]
+}
+
+// returns the transaction with the given hash, if it is in the chain
+func (index *AddressIndex) Find(hash []byte) (txnRef, bool) {
+	ref, ok := index.byHash[string(hash)]
+	return ref, ok
+}
+
+// brings the index in line with chain
+func (index *AddressIndex) Update(chain *BlockChain) {
+	same := 0
+	for same < len(index.blocks) && same < len(chain.Blocks) {
+		b := chain.Blocks[same]
+		if b != index.blocks[same] && !bytes.Equal(b.Hash(), index.hashes[same]) {
+			break
+		}
+		index.blocks[same] = b
+		same++
+	}
+
+	index.truncate(same)
+	for height := same; height < len(chain.Blocks); height++ {
+		index.add(chain.Blocks[height])
+	}
+}
+
+// forgets every block from height on
+func (index *AddressIndex) truncate(height int) {
+	for h := len(index.blocks) - 1; h >= height; h-- {
+		for _, addr := range index.touched[h] {
+			refs := index.byAddr[addr]
+			for len(refs) > 0 && refs[len(refs)-1].Height >= height {
+				delete(index.byHash, string(refs[len(refs)-1].Hash))
+				refs = refs[:len(refs)-1]
+			}
+			if len(refs) == 0 {
+				delete(index.byAddr, addr)
+			} else {
+				index.byAddr[addr] = refs
+			}
+		}
+	}
+
+	index.blocks = index.blocks[:height]
+	index.hashes = index.hashes[:height]
+	index.touched = index.touched[:height]
+}
+
+func (index *AddressIndex) add(b *Block) {
+	height := len(index.blocks)
+	var touched []Address
+
+	for pos, txn := range b.Txns {
+		ref := txnRef{txn, txn.Hash(), height, pos}
+		index.byHash[string(ref.Hash)] = ref
+		for _, addr := range txnAddresses(txn) {
+			index.byAddr[addr] = append(index.byAddr[addr], ref)
+			touched = append(touched, addr)
+		}
+	}
+
+	index.blocks = append(index.blocks, b)
+	index.hashes = append(index.hashes, b.Hash())
+	index.touched = append(index.touched, touched)
+}
+
+// returns the addresses a transaction spends from or pays, each once
+func txnAddresses(txn *Transaction) []Address {
+	var addrs []Address
+	seen := make(map[Address]bool)
+	for _, input := range txn.Inputs {
+		addr := AddressOf(&input.Key)
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, output := range txn.Outputs {
+		if !seen[output.Address] {
+			seen[output.Address] = true
+			addrs = append(addrs, output.Address)
+		}
+	}
+	return addrs
+}
+
+// HistoryEntry is a transaction that pays or spends from our wallet
+type HistoryEntry struct {
+	Txn           *Transaction
+	Hash          []byte
+	Status        TxnStatus
+	Height        int // index of its block in the primary chain, or -1 if it isn't in it
+	Confirmations int // how many blocks (its own included) have been mined on it
+
+	Received uint64 // paid to our addresses
+	Sent     uint64 // spent from our addresses
+
+	// for a payment to us, the addresses it spends from; for a payment we made,
+	// the addresses it pays other than our own. Empty for mining rewards
+	Counterparties []Address
+}
+
+// returns Received - Sent, which is negative for payments we made
+func (entry *HistoryEntry) Net() int64 {
+	return int64(entry.Received) - int64(entry.Sent)
+}
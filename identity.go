@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// Identity is the key a node uses to authenticate itself to its peers when
+// the encrypted transport is enabled. Peers are identified by the fingerprint
+// of their public key, which is pinned in the address book the first time we
+// connect to them; the certificate itself is self-signed and carries no meaning
+type Identity struct {
+	Fingerprint string
+	cert        tls.Certificate
+}
+
+// loads the identity key from path, generating (and saving) a new one if the
+// file doesn't exist; an empty path generates a fresh identity for this run only
+func LoadIdentity(path string) (*Identity, error) {
+	var key *ecdsa.PrivateKey
+
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			block, _ := pem.Decode(data)
+			if block == nil {
+				return nil, errors.New("Identity file is not PEM encoded")
+			}
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if key == nil {
+		var err error
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		if path != "" {
+			der, err := x509.MarshalECPrivateKey(key)
+			if err != nil {
+				return nil, err
+			}
+			data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+			err = ioutil.WriteFile(path, data, 0600)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "gocoin"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{certFingerprint(leaf), cert}, nil
+}
+
+// the fingerprint only covers the public key, so it stays the same when the
+// certificate is regenerated on each run
+func certFingerprint(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(hash[:])
+}
+
+// configuration for connecting to the peer at addr, whose identity must match
+// the one pinned for it in book (if any)
+func (id *Identity) clientConfig(addr string, book *AddrBook) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{id.cert},
+		MinVersion:   tls.VersionTLS13,
+		// peers use self-signed certificates, so skip the usual chain
+		// verification and check the pinned fingerprint instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("Peer sent no certificate")
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			if !book.Pin(addr, certFingerprint(cert)) {
+				return errors.New("Peer identity does not match the one pinned for " + addr)
+			}
+			return nil
+		},
+	}
+}
+
+// configuration for accepting peers; their identity can only be checked once
+// they tell us which address they are listening on
+func (id *Identity) serverConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{id.cert},
+		MinVersion:   tls.VersionTLS13,
+		ClientAuth:   tls.RequireAnyClientCert,
+	}
+}
+
+// returns the identity fingerprint of the peer on the other end of conn, or
+// the empty string if the connection is not encrypted
+func peerFingerprint(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certFingerprint(certs[0])
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// KeyScheme says which signature algorithm a key is for
+type KeyScheme byte
+
+const (
+	KeyRSA KeyScheme = iota
+	KeyEd25519
+	KeyECDSA // over P-256
+)
+
+var keySchemes = map[string]KeyScheme{
+	"rsa":     KeyRSA,
+	"ed25519": KeyEd25519,
+	"ecdsa":   KeyECDSA,
+}
+
+const defaultKeyScheme = "ed25519"
+
+func (scheme KeyScheme) String() string {
+	switch scheme {
+	case KeyRSA:
+		return "rsa"
+	case KeyEd25519:
+		return "ed25519"
+	case KeyECDSA:
+		return "ecdsa"
+	}
+	return "unknown"
+}
+
+// PublicKey is a public key of any scheme, in that scheme's usual encoding (PKCS#1
+// for RSA, an uncompressed point for ECDSA), so that transactions can mix keys
+// of different kinds
+type PublicKey struct {
+	Scheme KeyScheme
+	Data   []byte
+}
+
+// PrivateKey is a private key of any scheme, along with its public half
+type PrivateKey struct {
+	PublicKey PublicKey
+
+	rsa     *rsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+	ecdsa   *ecdsa.PrivateKey
+}
+
+// generates a new random key of the scheme chosen with --keytype
+func genKey() *PrivateKey {
+	return newKey(keyScheme)
+}
+
+func newKey(scheme KeyScheme) *PrivateKey {
+	switch scheme {
+	case KeyRSA:
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			panic(err)
+		}
+		return &PrivateKey{
+			PublicKey: PublicKey{KeyRSA, x509.MarshalPKCS1PublicKey(&key.PublicKey)},
+			rsa:       key,
+		}
+	case KeyEd25519:
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			panic(err)
+		}
+		return ed25519Key(seed)
+	case KeyECDSA:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		data, err := key.PublicKey.Bytes()
+		if err != nil {
+			panic(err)
+		}
+		return &PrivateKey{
+			PublicKey: PublicKey{KeyECDSA, data},
+			ecdsa:     key,
+		}
+	}
+	panic("unknown key scheme")
+}
+
+// returns the Ed25519 key made from the given 32-byte seed
+func ed25519Key(seed []byte) *PrivateKey {
+	key := ed25519.NewKeyFromSeed(seed)
+	return &PrivateKey{
+		PublicKey: PublicKey{KeyEd25519, []byte(key.Public().(ed25519.PublicKey))},
+		ed25519:   key,
+	}
+}
+
+// public keys are written as the scheme and the hex of the key, eg "ed25519:ab12..."
+func (key *PublicKey) String() string {
+	return key.Scheme.String() + ":" + hex.EncodeToString(key.Data)
+}
+
+// parses the string form of a public key, checking that it is a valid key
+func ParsePublicKey(s string) (*PublicKey, error) {
+	name, data, found := strings.Cut(s, ":")
+	scheme, ok := keySchemes[strings.ToLower(name)]
+	if !found || !ok {
+		return nil, errors.New("Invalid public key: should be <scheme>:<hex>, eg ed25519:ab12...")
+	}
+
+	key := &PublicKey{Scheme: scheme}
+	var err error
+	if key.Data, err = hex.DecodeString(data); err != nil || !key.valid() {
+		return nil, errors.New("Invalid public key: not a valid " + scheme.String() + " key")
+	}
+	return key, nil
+}
+
+// returns true if the key can be parsed according to its scheme
+func (key *PublicKey) valid() bool {
+	switch key.Scheme {
+	case KeyRSA:
+		_, err := x509.ParsePKCS1PublicKey(key.Data)
+		return err == nil
+	case KeyEd25519:
+		return len(key.Data) == ed25519.PublicKeySize
+	case KeyECDSA:
+		_, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), key.Data)
+		return err == nil
+	}
+	return false
+}
+
+func keysEql(a, b *PublicKey) bool {
+	return a.Scheme == b.Scheme && bytes.Equal(a.Data, b.Data)
+}
+
+// signs the hash of a transaction
+func (key *PrivateKey) Sign(hash []byte) ([]byte, error) {
+	switch key.PublicKey.Scheme {
+	case KeyRSA:
+		return rsa.SignPKCS1v15(rand.Reader, key.rsa, crypto.SHA256, hash)
+	case KeyEd25519:
+		return ed25519.Sign(key.ed25519, hash), nil
+	case KeyECDSA:
+		return ecdsa.SignASN1(rand.Reader, key.ecdsa, hash)
+	}
+	return nil, errors.New("unknown key scheme")
+}
+
+// returns true if sig is a valid signature of hash by this key. Keys come from
+// the network, so anything malformed is simply invalid
+func (key *PublicKey) Verify(hash, sig []byte) bool {
+	switch key.Scheme {
+	case KeyRSA:
+		pub, err := x509.ParsePKCS1PublicKey(key.Data)
+		if err != nil {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash, sig) == nil
+	case KeyEd25519:
+		if len(key.Data) != ed25519.PublicKeySize {
+			return false
+		}
+		return ed25519.Verify(ed25519.PublicKey(key.Data), hash, sig)
+	case KeyECDSA:
+		pub, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), key.Data)
+		if err != nil {
+			return false
+		}
+		return ecdsa.VerifyASN1(pub, hash, sig)
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+)
+
+var testSchemes = []KeyScheme{KeyRSA, KeyEd25519, KeyECDSA}
+
+// returns a typical transaction (spending one address and paying two) using keys
+// of the given scheme, along with the wallet that can sign it
+func schemeTxn(scheme KeyScheme) (*Transaction, map[Address]*PrivateKey) {
+	key := newKey(scheme)
+	txn := &Transaction{
+		Inputs: []TxnInput{{key.PublicKey, make([]byte, 32), nil}},
+		Outputs: []TxnOutput{
+			{AddressOf(&newKey(scheme).PublicKey), 10},
+			{AddressOf(&newKey(scheme).PublicKey), 5},
+		},
+	}
+	return txn, map[Address]*PrivateKey{AddressOf(&key.PublicKey): key}
+}
+
+func TestSignVerify(t *testing.T) {
+	for _, scheme := range testSchemes {
+		txn, wallet := schemeTxn(scheme)
+		if err := txn.Sign(wallet); err != nil {
+			t.Fatalf("%s: %v", scheme, err)
+		}
+		if !txn.VerifySignatures() {
+			t.Errorf("%s: signature doesn't verify", scheme)
+		}
+
+		txn.Outputs[0].Amount++
+		if txn.VerifySignatures() {
+			t.Errorf("%s: signature verifies for a different txn", scheme)
+		}
+
+		parsed, err := ParsePublicKey(txn.Inputs[0].Key.String())
+		if err != nil || !keysEql(parsed, &txn.Inputs[0].Key) {
+			t.Errorf("%s: key doesn't survive being printed and parsed: %v", scheme, err)
+		}
+	}
+}
+
+func BenchmarkKeygen(b *testing.B) {
+	for _, scheme := range testSchemes {
+		b.Run(scheme.String(), func(b *testing.B) {
+			var key *PrivateKey
+			for i := 0; i < b.N; i++ {
+				key = newKey(scheme)
+			}
+			b.ReportMetric(float64(len(key.PublicKey.Data)), "key-bytes")
+		})
+	}
+}
+
+// signing and verifying both include hashing the txn, as they always do in use
+func BenchmarkSign(b *testing.B) {
+	for _, scheme := range testSchemes {
+		b.Run(scheme.String(), func(b *testing.B) {
+			txn, wallet := schemeTxn(scheme)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := txn.Sign(wallet); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(txn.Inputs[0].Signature)), "sig-bytes")
+			b.ReportMetric(float64(txn.Size()), "txn-bytes")
+		})
+	}
+}
+
+func BenchmarkVerify(b *testing.B) {
+	for _, scheme := range testSchemes {
+		b.Run(scheme.String(), func(b *testing.B) {
+			txn, wallet := schemeTxn(scheme)
+			if err := txn.Sign(wallet); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !txn.VerifySignatures() {
+					b.Fatal("txn failed to verify")
+				}
+			}
+		})
+	}
+}
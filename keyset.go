@@ -4,7 +4,8 @@ import (
 	"bytes"
 )
 
-type KeySet map[string]*Transaction
+// KeySet maps each address holding unspent coins to the transaction that paid it
+type KeySet map[Address]*Transaction
 
 func (set KeySet) Copy() KeySet {
 	tmp := make(KeySet, len(set))
@@ -21,10 +22,22 @@ func (set KeySet) AddTxn(txn *Transaction) bool {
 		return false
 	}
 
-	var inTotal, outTotal uint64
+	if !set.payable(txn) {
+		logger.Println("Txn pays an address that already holds coins")
+		return false
+	}
+
+	outTotal, ok := txn.CheckedTotal()
+	if !ok {
+		logger.Println("Txn outputs overflow!")
+		return false
+	}
+
+	var inTotal uint64
 
 	for _, input := range txn.Inputs {
-		prev := set[input.Key.N.String()]
+		addr := AddressOf(&input.Key)
+		prev := set[addr]
 		if prev == nil {
 			return false // this is normal if, eg, the txn is stale
 		}
@@ -32,24 +45,72 @@ func (set KeySet) AddTxn(txn *Transaction) bool {
 			logger.Println("Keyset corrupt!")
 			return false
 		}
-		exists, amount := prev.OutputAmount(input.Key)
+		exists, amount := prev.OutputAmount(addr)
 		if !exists {
 			logger.Println("Keyset corrupt!")
 			return false
 		}
-		inTotal += amount
-		delete(set, input.Key.N.String())
+		if inTotal, ok = addAmounts(inTotal, amount); !ok {
+			logger.Println("Keyset corrupt!")
+			return false
+		}
+		delete(set, addr)
 	}
 
 	for _, output := range txn.Outputs {
-		outTotal += output.Amount
-		set[output.Key.N.String()] = txn
+		set[output.Address] = txn
 	}
 
-	if inTotal != outTotal && !txn.IsMiner() {
+	// anything left over is a fee for the miner
+	if inTotal < outTotal && !txn.IsMiner() {
 		logger.Println("Txn corrupt!", inTotal, outTotal)
 		return false
 	}
 
 	return true
 }
+
+// returns false if txn pays an address that holds coins it doesn't spend, or
+// pays the same address twice. Each address holds the coins from only one txn,
+// so the later payment would replace the earlier one and its coins would be lost
+func (set KeySet) payable(txn *Transaction) bool {
+	spent := make(map[Address]bool)
+	for _, input := range txn.Inputs {
+		spent[AddressOf(&input.Key)] = true
+	}
+
+	paid := make(map[Address]bool)
+	for _, output := range txn.Outputs {
+		if paid[output.Address] || (set[output.Address] != nil && !spent[output.Address]) {
+			return false
+		}
+		paid[output.Address] = true
+	}
+	return true
+}
+
+// returns the fee paid by txn (its inputs less its outputs), and false if any
+// of its inputs aren't in the set
+func (set KeySet) Fee(txn *Transaction) (uint64, bool) {
+	var inTotal uint64
+
+	for _, input := range txn.Inputs {
+		addr := AddressOf(&input.Key)
+		prev := set[addr]
+		if prev == nil {
+			return 0, false
+		}
+		_, amount := prev.OutputAmount(addr)
+		var ok bool
+		if inTotal, ok = addAmounts(inTotal, amount); !ok {
+			return 0, false
+		}
+	}
+
+	outTotal, ok := txn.CheckedTotal()
+	if !ok || outTotal > inTotal {
+		return 0, false
+	}
+
+	return inTotal - outTotal, true
+}
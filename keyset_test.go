@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestKeySetRefusesFundedAddress(t *testing.T) {
+	alice, bob, carol := genKey(), genKey(), genKey()
+	wallet := map[Address]*PrivateKey{
+		AddressOf(&alice.PublicKey): alice,
+		AddressOf(&bob.PublicKey):   bob,
+	}
+
+	set := make(KeySet)
+	for _, key := range []*PrivateKey{alice, bob} {
+		if !set.AddTxn(NewMinersTransation(AddressOf(&key.PublicKey), 0)) {
+			t.Fatal("couldn't fund address")
+		}
+	}
+
+	pay := func(from *PrivateKey, outputs ...TxnOutput) *Transaction {
+		txn := &Transaction{
+			Inputs:  []TxnInput{{from.PublicKey, set[AddressOf(&from.PublicKey)].Hash(), nil}},
+			Outputs: outputs,
+		}
+		if err := txn.Sign(wallet); err != nil {
+			t.Fatal(err)
+		}
+		return txn
+	}
+
+	aliceAddr, bobAddr, carolAddr := AddressOf(&alice.PublicKey), AddressOf(&bob.PublicKey), AddressOf(&carol.PublicKey)
+	tests := []struct {
+		name    string
+		txn     *Transaction
+		payable bool
+	}{
+		{"to a funded address", pay(alice, TxnOutput{bobAddr, 1}), false},
+		{"to the same address twice", pay(alice, TxnOutput{carolAddr, 1}, TxnOutput{carolAddr, 1}), false},
+		{"back to the address it spends", pay(alice, TxnOutput{aliceAddr, 1}), true},
+		{"to a new address", pay(alice, TxnOutput{carolAddr, 1}), true},
+	}
+
+	for _, test := range tests {
+		tmp := set.Copy()
+		if got := tmp.AddTxn(test.txn); got != test.payable {
+			t.Errorf("paying %s: got %v, want %v", test.name, got, test.payable)
+		}
+		if !test.payable && tmp[bobAddr] != set[bobAddr] {
+			t.Errorf("paying %s replaced bob's coins", test.name)
+		}
+	}
+}
+
+func TestKeySetRefusesOverflow(t *testing.T) {
+	key := genKey()
+	set := make(KeySet)
+	funding := NewMinersTransation(AddressOf(&key.PublicKey), 0)
+	set.AddTxn(funding)
+
+	// the outputs wrap around to 5, less than the 10 coins spent
+	txn := &Transaction{
+		Inputs: []TxnInput{{key.PublicKey, funding.Hash(), nil}},
+		Outputs: []TxnOutput{
+			{AddressOf(&genKey().PublicKey), math.MaxUint64},
+			{AddressOf(&genKey().PublicKey), 6},
+		},
+	}
+	if err := txn.Sign(map[Address]*PrivateKey{AddressOf(&key.PublicKey): key}); err != nil {
+		t.Fatal(err)
+	}
+
+	if fee, ok := set.Fee(txn); ok {
+		t.Errorf("got fee %d for a txn whose outputs overflow", fee)
+	}
+	if set.AddTxn(txn) {
+		t.Error("accepted a txn whose outputs overflow")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// the largest encoded message of each type we are willing to receive; a peer that
+// sends anything bigger (or of a type not listed here) is disconnected
+var maxMsgSize = map[MsgType]uint32{
+	PeerListRequest:  1 << 10,
+	PeerListResponse: 64 << 10,
+	PeerBroadcast:    1 << 10,
+
+	BlockChainRequest:  1 << 10,
+	BlockChainResponse: 64 << 20,
+	BlockBroadcast:     4 << 20,
+	BlockRequest:       1 << 10,
+	BlockResponse:      4 << 20,
+
+	TransactionRequest:   1 << 10,
+	TransactionResponse:  4 << 10,
+	TransactionBroadcast: 256 << 10,
+
+	Ping: 1 << 10,
+	Pong: 1 << 10,
+}
+
+var errMsgTooLarge = errors.New("Message too large")
+
+type msgRate struct {
+	perSecond float64
+	burst     float64
+}
+
+// how often each peer may send us each type of message; anything over the limit
+// is ignored. types not listed here are not limited
+var msgRates = map[MsgType]msgRate{
+	BlockChainRequest:  {1, 5},
+	BlockChainResponse: {1, 5},
+	BlockBroadcast:     {5, 20},
+	BlockRequest:       {10, 20},
+	BlockResponse:      {10, 20},
+
+	TransactionRequest:   {0.5, 5}, // each one costs us a new key
+	TransactionResponse:  {1, 5},
+	TransactionBroadcast: {20, 100},
+
+	Ping: {1, 5},
+	Pong: {1, 5},
+}
+
+// the most keys we will hand out to a single peer that it hasn't yet paid
+// anything to; past that point we refuse to give it any more (reusing one would
+// mean a second payment to it replaced the first). Keys that the peer hasn't
+// paid to within keyExpiry no longer count, and all of them are forgotten once
+// the peer disconnects
+const (
+	maxOutstandingKeys = 5
+	keyExpiry          = 10 * time.Minute
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter tracks a token bucket per message type for a single peer; it is
+// only used by the goroutine receiving from that peer, so needs no lock
+type RateLimiter struct {
+	buckets map[MsgType]*tokenBucket
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: make(map[MsgType]*tokenBucket)}
+}
+
+// returns true if a message of type t should be accepted, consuming a token
+func (limiter *RateLimiter) Allow(t MsgType) bool {
+	rate, limited := msgRates[t]
+	if !limited {
+		return true
+	}
+
+	now := time.Now()
+	bucket := limiter.buckets[t]
+	if bucket == nil {
+		bucket = &tokenBucket{rate.burst, now}
+		limiter.buckets[t] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * rate.perSecond
+	if bucket.tokens > rate.burst {
+		bucket.tokens = rate.burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
@@ -1,51 +1,78 @@
 package main
 
 import (
-	"crypto/rsa"
 	"encoding/gob"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 )
 
 var network *PeerNetwork
 var state *State
 var logger *log.Logger
-var delay *bool
+var coinSelector CoinSelector
+var keyScheme KeyScheme
 
 func main() {
-	// these are used as interface values so must be registered first
-	gob.Register(Block{})
-	gob.Register(BlockChain{})
-	gob.Register(Transaction{})
-	gob.Register(rsa.PublicKey{})
-
-	// XXX so it appears that "gob" assigns type IDs consecutively as they are used, which
-	// means that if two processes encode different types first, the same type will get different IDs,
-	// meaning that the same object in the two processes will hash to different values! This is obviously
-	// a problem for us, since we have to verify hashes across processes, so encode all of our types right
-	// away in a specific order so that all processes assign them the same type IDs
-	encoder := gob.NewEncoder(ioutil.Discard)
-	encoder.Encode(Block{})
-	encoder.Encode(BlockChain{})
-	encoder.Encode(TxnInput{})
-	encoder.Encode(TxnOutput{})
-	encoder.Encode(Transaction{})
-	encoder.Encode(rsa.PublicKey{})
+	registerTypes()
 
 	rand.Seed(time.Now().UnixNano())
 
-	initialPeer := flag.String("connect", "", "Address of peer to connect to, leave blank for new network")
+	initialPeers := flag.String("connect", "", "Comma-separated addresses of peers to connect to, leave blank for new network")
+	addrBook := flag.String("addrbook", "", "File in which to remember known peers, leave blank to not save them")
+	encrypt := flag.Bool("tls", false, "Encrypt and authenticate connections to peers (all peers must agree)")
+	identityFile := flag.String("identity", "", "File holding this peer's identity key for --tls, leave blank for a new one each run")
 	address := flag.String("listen", "localhost:0", "Address to listen on, defaults to random local port")
+	advertise := flag.String("advertise", "", "Address for peers to connect to us on, defaults to the listening address")
 	verbose := flag.Bool("verbose", false, "Print logs to the terminal")
-	delay = flag.Bool("delay", false, "Delay network events for debugging/demo purposes")
+	simScript := flag.String("sim", "", "Run the simulation script in the given file instead of a normal peer")
+	delay := flag.Bool("delay", false, "Delay network events for debugging/demo purposes")
+	watch := flag.String("watch", "", "File of addresses or public keys to follow without being able to spend from them")
+	seedFile := flag.String("seed", "", "Derive the wallet's keys from the seed phrase in the given file (recovering its coins), \"-\" to type it in, or \"new\" for a new one")
+	keyType := flag.String("keytype", defaultKeyScheme, "Kind of key to make for a wallet without a seed: ed25519, ecdsa or rsa")
+	coins := flag.String("coins", defaultCoinSelector, "How to choose which coins to pay with: largest, smallest, bnb or privacy")
 	flag.Parse()
 
+	coinSelector = coinSelectors[*coins]
+	if coinSelector == nil {
+		fmt.Printf("Unknown coin selection strategy %q\n", *coins)
+		os.Exit(1)
+	}
+
+	scheme, ok := keySchemes[*keyType]
+	if !ok {
+		fmt.Printf("Unknown key type %q\n", *keyType)
+		os.Exit(1)
+	}
+	keyScheme = scheme
+
+	var seed *Seed
+	if *seedFile == "new" {
+		seed = NewSeed()
+		fmt.Println("Your wallet's seed phrase is:")
+		fmt.Println()
+		fmt.Println("  ", seed.Phrase())
+		fmt.Println()
+		fmt.Println("Write it down: it is all you need to recover the wallet with --seed.")
+	} else if *seedFile != "" {
+		phrase, err := readSeedPhrase(*seedFile)
+		if err == nil {
+			seed, err = ParseSeedPhrase(phrase)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
 	// XXX so mining doesn't block everything, since the goroutine scheduler only kicks in on
 	// system calls which mining doesn't make in the CPU-intensive path
 	runtime.GOMAXPROCS(2)
@@ -56,20 +83,72 @@ func main() {
 		logger = log.New(ioutil.Discard, "", 0)
 	}
 
-	var err error
-	network, err = NewPeerNetwork(*address, *initialPeer)
+	if *simScript != "" {
+		err := RunSimulation(*simScript)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	book, err := LoadAddrBook(*addrBook)
 	if err != nil {
 		panic(err)
 	}
 
+	var seeds []string
+	for _, seed := range strings.Split(*initialPeers, ",") {
+		if seed = strings.TrimSpace(seed); seed != "" {
+			seeds = append(seeds, seed)
+		}
+	}
+
+	// the network starts handling events straight away, so we need somewhere to put them
 	state = NewState()
+	state.Notify = alertUser
+	if seed != nil {
+		state.SetSeed(seed)
+	}
+	if *watch != "" {
+		if err := watchFile(*watch); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	var identity *Identity
+	if *encrypt {
+		identity, err = LoadIdentity(*identityFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var transport Transport = TCPTransport{}
+	if *delay {
+		transport = DelayTransport{transport, 2 * time.Second}
+	}
+
+	network, err = NewPeerNetwork(PeerNetworkConfig{
+		Address:   *address,
+		Advertise: *advertise,
+		Seeds:     seeds,
+		Book:      book,
+		Identity:  identity,
+		Transport: transport,
+		State:     state,
+	})
+	if err != nil {
+		panic(err)
+	}
 
 	network.RequestBlockChain("", nil) // get the primary chain from a random peer
 
 	stopper := make(chan bool)
-	go MineForGold(stopper)
+	go MineForGold(state, network, stopper)
 
-	fmt.Printf("Startup complete, listening on \"%v\"\n", network.server.Addr())
+	fmt.Printf("Startup complete, listening on \"%v\"\n", network.Addr())
 
 	mainLoop()
 
@@ -77,28 +156,93 @@ func main() {
 	network.Close()
 }
 
-func MineForGold(stopper chan bool) {
+// reads a seed phrase from the given file, or from the terminal if it is "-". It
+// is never taken as a flag itself, since then it would show up in the process
+// list and the shell's history
+func readSeedPhrase(path string) (string, error) {
+	if strings.Contains(path, " ") {
+		return "", errors.New("--seed takes a file holding the seed phrase (or - to type it in), not the phrase itself")
+	}
+	if path != "-" {
+		data, err := ioutil.ReadFile(path)
+		return strings.TrimSpace(string(data)), err
+	}
+
+	// one byte at a time, so as not to swallow anything typed after it that
+	// is meant for the UI
+	fmt.Print("Enter the wallet's seed phrase: ")
+	var phrase []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if n == 1 && b[0] != '\n' {
+			phrase = append(phrase, b[0])
+			continue
+		}
+		if n == 1 || err == io.EOF {
+			return strings.TrimSpace(string(phrase)), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// registers our types with gob and gives them the same type IDs in every process
+func registerTypes() {
+	// these are used as interface values so must be registered first
+	gob.Register(Block{})
+	gob.Register(BlockChain{})
+	gob.Register(Transaction{})
+	gob.Register(PublicKey{})
+	gob.Register(Address{})
+	gob.Register(PeerHello{})
+
+	// XXX so it appears that "gob" assigns type IDs consecutively as they are used, which
+	// means that if two processes encode different types first, the same type will get different IDs,
+	// meaning that the same object in the two processes will hash to different values! This is obviously
+	// a problem for us, since we have to verify hashes across processes, so encode all of our types right
+	// away in a specific order so that all processes assign them the same type IDs
+	encoder := gob.NewEncoder(ioutil.Discard)
+	encoder.Encode(Block{})
+	encoder.Encode(BlockChain{})
+	encoder.Encode(TxnInput{})
+	encoder.Encode(TxnOutput{})
+	encoder.Encode(Transaction{})
+	encoder.Encode(PublicKey{})
+	encoder.Encode(Address{})
+	encoder.Encode(PeerHello{})
+}
+
+func MineForGold(s *State, n *PeerNetwork, stopper chan bool) {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 
+	for mineBlock(s, n, r, stopper) {
+	}
+}
+
+// mines on top of the primary chain until a block is found, returning false if
+// told to stop first
+func mineBlock(s *State, n *PeerNetwork, r *rand.Rand, stopper chan bool) bool {
 mineNewBlock:
 	for {
 		logger.Println("Mining new block")
-		b, key := state.ConstructBlock()
+		b, key := s.ConstructBlock()
 		for {
-			if state.ResetMiner {
+			if s.ResetMiner {
 				continue mineNewBlock
 			}
 			select {
 			case <-stopper:
-				return
+				return false
 			default:
 				b.Nonce = r.Uint32()
-				success, _ := state.AddBlock(b)
-				if success {
+				added, _, _ := s.AddBlock(b)
+				if len(added) > 0 {
 					logger.Println("Successfully mined block")
-					state.AddToWallet(key)
-					network.BroadcastBlock(b)
-					continue mineNewBlock
+					s.AddToWallet(key)
+					n.BroadcastBlock(b)
+					return true
 				}
 			}
 		}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	registerTypes()
+	logger = log.New(ioutil.Discard, "", 0)
+	keyScheme = KeyEd25519
+	os.Exit(m.Run())
+}
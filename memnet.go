@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemNetwork is an in-process network for running many peers in one process (for
+// tests and simulations) with controllable latency, message loss and partitions.
+// Each node gets its own Transport from the network; a node's listening address
+// is simply its name. Every write to a connection is delivered (or lost) as a
+// whole, and since a PeerConn writes each message in one go, losing a write on
+// an unencrypted connection loses exactly one message
+type MemNetwork struct {
+	listeners map[string]*memListener
+	groups    map[string]int // partition group of each node, missing means 0
+	latency   time.Duration
+	jitter    time.Duration
+	delays    map[MsgType]time.Duration // extra latency for particular messages
+	loss      float64
+	rand      *rand.Rand
+	nextPort  int
+	lock      sync.Mutex
+}
+
+var (
+	errMemRefused     = errors.New("connection refused")
+	errMemUnreachable = errors.New("host unreachable")
+)
+
+// creates a network with no latency, loss or partitions; seed controls the
+// random choices of latency and loss
+func NewMemNetwork(seed int64) *MemNetwork {
+	return &MemNetwork{
+		listeners: make(map[string]*memListener),
+		groups:    make(map[string]int),
+		delays:    make(map[MsgType]time.Duration),
+		rand:      rand.New(rand.NewSource(seed)),
+	}
+}
+
+// returns the transport to be used by the named node
+func (mn *MemNetwork) Transport(node string) Transport {
+	return &memTransport{mn, node}
+}
+
+// every write takes latency plus a random amount of up to jitter to arrive
+func (mn *MemNetwork) SetLatency(latency, jitter time.Duration) {
+	mn.lock.Lock()
+	defer mn.lock.Unlock()
+
+	mn.latency = latency
+	mn.jitter = jitter
+}
+
+// messages of type t take an extra delay to arrive. This only works on unencrypted
+// connections, where each write is a message frame that starts with its type.
+// Connections are still streams, so anything sent after the message is held up too
+func (mn *MemNetwork) SetTypeDelay(t MsgType, delay time.Duration) {
+	mn.lock.Lock()
+	defer mn.lock.Unlock()
+
+	mn.delays[t] = delay
+}
+
+// each write is lost with the given probability
+func (mn *MemNetwork) SetLoss(fraction float64) {
+	mn.lock.Lock()
+	defer mn.lock.Unlock()
+
+	mn.loss = fraction
+}
+
+// splits the network so that nodes can only reach other nodes in the same group;
+// nodes that aren't listed end up together in an extra group. Anything written
+// across the partition is silently lost, and new connections across it fail
+func (mn *MemNetwork) Partition(groups ...[]string) {
+	mn.lock.Lock()
+	defer mn.lock.Unlock()
+
+	mn.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, node := range group {
+			mn.groups[node] = i + 1
+		}
+	}
+}
+
+// removes any partition
+func (mn *MemNetwork) Heal() {
+	mn.Partition()
+}
+
+// *must* be called while holding the lock
+func (mn *MemNetwork) reachable(a, b string) bool {
+	return mn.groups[a] == mn.groups[b]
+}
+
+// decides the fate of a write of data from node a to node b: whether it arrives,
+// and if so how long it takes
+func (mn *MemNetwork) route(a, b string, data []byte) (bool, time.Duration) {
+	mn.lock.Lock()
+	defer mn.lock.Unlock()
+
+	if !mn.reachable(a, b) || (mn.loss > 0 && mn.rand.Float64() < mn.loss) {
+		return false, 0
+	}
+
+	latency := mn.latency
+	if mn.jitter > 0 {
+		latency += time.Duration(mn.rand.Int63n(int64(mn.jitter)))
+	}
+	if len(data) >= frameHeaderLength {
+		latency += mn.delays[MsgType(binary.BigEndian.Uint32(data[0:4]))]
+	}
+	return true, latency
+}
+
+type memAddr string
+
+func (addr memAddr) Network() string { return "mem" }
+func (addr memAddr) String() string  { return string(addr) }
+
+type memTransport struct {
+	mn   *MemNetwork
+	node string
+}
+
+// the address is always the node's name, unless a specific (non-zero port) one is given
+func (t *memTransport) Listen(addr string) (net.Listener, error) {
+	if addr == "" || addr == "localhost:0" || addr == ":0" {
+		addr = t.node
+	}
+
+	t.mn.lock.Lock()
+	defer t.mn.lock.Unlock()
+
+	if t.mn.listeners[addr] != nil {
+		return nil, errors.New("address already in use")
+	}
+
+	l := &memListener{
+		mn:     t.mn,
+		node:   t.node,
+		addr:   memAddr(addr),
+		accept: make(chan *memConn, 16),
+		done:   make(chan struct{}),
+	}
+	t.mn.listeners[addr] = l
+	return l, nil
+}
+
+func (t *memTransport) Dial(addr string) (net.Conn, error) {
+	t.mn.lock.Lock()
+	defer t.mn.lock.Unlock()
+
+	l := t.mn.listeners[addr]
+	if l == nil {
+		return nil, errMemRefused
+	}
+	if !t.mn.reachable(t.node, l.node) {
+		return nil, errMemUnreachable
+	}
+
+	t.mn.nextPort++
+	local := memAddr(t.node + ":" + strconv.Itoa(t.mn.nextPort))
+
+	client := &memConn{mn: t.mn, node: t.node, remoteNode: l.node, local: local, remote: l.addr}
+	server := &memConn{mn: t.mn, node: l.node, remoteNode: t.node, local: l.addr, remote: local}
+	for _, c := range []*memConn{client, server} {
+		c.in = make(chan memPacket, 1024)
+		c.closed = make(chan struct{})
+	}
+	client.peer = server
+	server.peer = client
+
+	select {
+	case l.accept <- server:
+		return client, nil
+	default:
+		return nil, errMemRefused
+	}
+}
+
+type memListener struct {
+	mn     *MemNetwork
+	node   string
+	addr   memAddr
+	accept chan *memConn
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		l.mn.lock.Lock()
+		delete(l.mn.listeners, string(l.addr))
+		l.mn.lock.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+type memPacket struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+// memConn is one end of an in-memory connection. As with TCP, once the other end
+// is closed we can still read anything it wrote before closing, but no more
+type memConn struct {
+	mn               *MemNetwork
+	node, remoteNode string
+	local, remote    memAddr
+	peer             *memConn
+
+	in        chan memPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	held    *memPacket // taken from in, but not due to be delivered yet
+	unread  []byte     // the rest of a packet that didn't fit in the last Read
+	lastDue time.Time  // when the last packet we wrote is due, so we don't reorder
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	lock          sync.Mutex
+}
+
+func (c *memConn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	deadline := c.readDeadline
+	c.lock.Unlock()
+
+	if len(c.unread) > 0 {
+		n := copy(b, c.unread)
+		c.unread = c.unread[n:]
+		return n, nil
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	if c.held == nil {
+		var packet memPacket
+		select {
+		case packet = <-c.in:
+		case <-c.closed:
+			return 0, net.ErrClosed
+		case <-c.peer.closed:
+			// the peer can't write anything more, but may have written
+			// something before closing
+			select {
+			case packet = <-c.in:
+			default:
+				return 0, io.EOF
+			}
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.held = &packet
+	}
+
+	if wait := time.Until(c.held.deliverAt); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-c.closed:
+			return 0, net.ErrClosed
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	n := copy(b, c.held.data)
+	c.unread = c.held.data[n:]
+	c.held = nil
+	return n, nil
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-c.peer.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	arrives, latency := c.mn.route(c.node, c.remoteNode, b)
+	if !arrives {
+		return len(b), nil
+	}
+
+	c.lock.Lock()
+	due := time.Now().Add(latency)
+	if due.Before(c.lastDue) {
+		due = c.lastDue
+	}
+	c.lastDue = due
+	deadline := c.writeDeadline
+	c.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	packet := memPacket{append([]byte(nil), b...), due}
+	select {
+	case c.peer.in <- packet:
+		return len(b), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-c.peer.closed:
+		return 0, io.ErrClosedPipe
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *memConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	return nil
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeDeadline = t
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// the most (encoded) transaction bytes we keep waiting to be mined, and
+	// how long we keep any one transaction waiting
+	mempoolMaxBytes = 1 << 20
+	mempoolExpiry   = 30 * time.Minute
+)
+
+type MempoolEntry struct {
+	Txn   *Transaction
+	Hash  []byte
+	Size  int    // bytes, encoded
+	Fee   uint64 // inputs less outputs
+	Added time.Time
+}
+
+// fee paid per kilobyte of transaction, which is what miners care about
+func (entry *MempoolEntry) FeeRate() float64 {
+	return float64(entry.Fee) * 1024 / float64(entry.Size)
+}
+
+// Mempool holds the valid transactions that are waiting to be mined, in the
+// order they arrived (so any transaction comes after those it spends from).
+// It is owned by State, and like State's private functions must only be used
+// while holding State's lock
+type Mempool struct {
+	entries map[string]*MempoolEntry // by hash
+	order   []*MempoolEntry
+	spends  map[Address]*MempoolEntry // by the address of each input
+	bytes   int
+
+	MaxBytes int
+	Expiry   time.Duration
+}
+
+func NewMempool() *Mempool {
+	return &Mempool{
+		entries:  make(map[string]*MempoolEntry),
+		spends:   make(map[Address]*MempoolEntry),
+		MaxBytes: mempoolMaxBytes,
+		Expiry:   mempoolExpiry,
+	}
+}
+
+func (pool *Mempool) Len() int {
+	return len(pool.order)
+}
+
+func (pool *Mempool) Bytes() int {
+	return pool.bytes
+}
+
+func (pool *Mempool) Get(hash []byte) *MempoolEntry {
+	return pool.entries[string(hash)]
+}
+
+// returns the entries in arrival order
+func (pool *Mempool) Entries() []*MempoolEntry {
+	return append([]*MempoolEntry(nil), pool.order...)
+}
+
+func (pool *Mempool) Txns() []*Transaction {
+	txns := make([]*Transaction, len(pool.order))
+	for i, entry := range pool.order {
+		txns[i] = entry.Txn
+	}
+	return txns
+}
+
+// returns the entries that spend from any of the same addresses as txn
+func (pool *Mempool) Conflicts(txn *Transaction) []*MempoolEntry {
+	var conflicts []*MempoolEntry
+	for _, input := range txn.Inputs {
+		entry := pool.spends[AddressOf(&input.Key)]
+		if entry == nil {
+			continue
+		}
+		dup := false
+		for _, other := range conflicts {
+			dup = dup || other == entry
+		}
+		if !dup {
+			conflicts = append(conflicts, entry)
+		}
+	}
+	return conflicts
+}
+
+// adds a transaction, which the caller must already have validated, and which
+// must not conflict with any already in the pool
+func (pool *Mempool) Add(txn *Transaction, fee uint64) *MempoolEntry {
+	entry := &MempoolEntry{txn, txn.Hash(), txn.Size(), fee, time.Now()}
+
+	pool.entries[string(entry.Hash)] = entry
+	pool.order = append(pool.order, entry)
+	for _, input := range txn.Inputs {
+		pool.spends[AddressOf(&input.Key)] = entry
+	}
+	pool.bytes += entry.Size
+
+	return entry
+}
+
+// returns the given entries along with any entries spending from them (and any
+// spending from those, and so on), in order
+func (pool *Mempool) Descendants(entries []*MempoolEntry) []*MempoolEntry {
+	including := make(map[string]bool)
+	for _, entry := range entries {
+		including[string(entry.Hash)] = true
+	}
+
+	// anything spending from an entry comes after it, so one pass in order
+	// catches the descendants of descendants too
+	var descendants []*MempoolEntry
+	for _, entry := range pool.order {
+		include := including[string(entry.Hash)]
+		for _, input := range entry.Txn.Inputs {
+			include = include || including[string(input.PrevHash)]
+		}
+
+		if include {
+			including[string(entry.Hash)] = true
+			descendants = append(descendants, entry)
+		}
+	}
+
+	return descendants
+}
+
+// removes the transaction with the given hash, along with any transactions
+// spending from it (since they can no longer be valid), returning all of them
+func (pool *Mempool) Remove(hash []byte) []*MempoolEntry {
+	entry := pool.entries[string(hash)]
+	if entry == nil {
+		return nil
+	}
+
+	removed := pool.Descendants([]*MempoolEntry{entry})
+	removing := make(map[*MempoolEntry]bool)
+	for _, entry := range removed {
+		removing[entry] = true
+		delete(pool.entries, string(entry.Hash))
+		for _, input := range entry.Txn.Inputs {
+			delete(pool.spends, AddressOf(&input.Key))
+		}
+		pool.bytes -= entry.Size
+	}
+
+	var kept []*MempoolEntry
+	for _, entry := range pool.order {
+		if !removing[entry] {
+			kept = append(kept, entry)
+		}
+	}
+	pool.order = kept
+
+	return removed
+}
+
+// removes just the transaction with the given hash, which has been mined,
+// leaving any transactions spending from it (which are still valid)
+func (pool *Mempool) RemoveMined(hash []byte) *MempoolEntry {
+	entry := pool.entries[string(hash)]
+	if entry == nil {
+		return nil
+	}
+
+	delete(pool.entries, string(hash))
+	for _, input := range entry.Txn.Inputs {
+		delete(pool.spends, AddressOf(&input.Key))
+	}
+	pool.bytes -= entry.Size
+
+	for i := range pool.order {
+		if pool.order[i] == entry {
+			pool.order = append(pool.order[:i], pool.order[i+1:]...)
+			break
+		}
+	}
+
+	return entry
+}
+
+// removes transactions that have been waiting longer than Expiry
+func (pool *Mempool) Expire() []*MempoolEntry {
+	var removed []*MempoolEntry
+	for _, entry := range pool.Entries() {
+		if time.Since(entry.Added) > pool.Expiry && pool.Get(entry.Hash) != nil {
+			logger.Printf("Expiring txn %x", entry.Hash[:6])
+			removed = append(removed, pool.Remove(entry.Hash)...)
+		}
+	}
+	return removed
+}
+
+// removes transactions, lowest fee rate first, until the pool fits in MaxBytes
+func (pool *Mempool) Evict() []*MempoolEntry {
+	if pool.bytes <= pool.MaxBytes {
+		return nil
+	}
+
+	byRate := pool.Entries()
+	sort.SliceStable(byRate, func(i, j int) bool {
+		if byRate[i].FeeRate() != byRate[j].FeeRate() {
+			return byRate[i].FeeRate() < byRate[j].FeeRate()
+		}
+		// among equals, the newest goes first
+		return byRate[i].Added.After(byRate[j].Added)
+	})
+
+	var removed []*MempoolEntry
+	for _, entry := range byRate {
+		if pool.bytes <= pool.MaxBytes {
+			break
+		}
+		if pool.Get(entry.Hash) != nil {
+			logger.Printf("Evicting txn %x", entry.Hash[:6])
+			removed = append(removed, pool.Remove(entry.Hash)...)
+		}
+	}
+	return removed
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
-	"crypto/rsa"
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"io"
@@ -21,14 +24,33 @@ const (
 	BlockChainRequest  MsgType = iota
 	BlockChainResponse MsgType = iota
 	BlockBroadcast     MsgType = iota
+	BlockRequest       MsgType = iota
+	BlockResponse      MsgType = iota
 
 	TransactionRequest   MsgType = iota
 	TransactionResponse  MsgType = iota
 	TransactionBroadcast MsgType = iota
 
+	Ping MsgType = iota
+	Pong MsgType = iota
+
 	Error MsgType = iota
 )
 
+const (
+	// how often we ping each peer; peers that we haven't heard anything from
+	// (not even a pong) in peerTimeout are assumed dead and are dropped
+	pingInterval = 10 * time.Second
+	peerTimeout  = 3 * pingInterval
+	writeTimeout = 10 * time.Second
+)
+
+// sent by each side when a permanent connection is opened
+type PeerHello struct {
+	Addr   string // the address the peer is listening on
+	NodeID uint64 // chosen randomly at startup, identifies the peer whatever its address
+}
+
 type NetworkMessage struct {
 	Type  MsgType
 	Value interface{}
@@ -36,127 +58,436 @@ type NetworkMessage struct {
 	addr string // filled on the receiving side
 }
 
+// how many outgoing messages may be queued for a peer before we decide it is too
+// slow to keep up; once the queue is half full we stop bothering to send it
+// broadcasts (it can always ask for the chain again later)
+const sendQueueLength = 64
+
+// when a block arrives before its parent we ask for the parent on its own, and
+// so on back until we find one we have; past this many we ask for the whole
+// chain instead, since we're clearly a long way behind
+const maxBlockRequests = 8
+
+var (
+	errPeerClosed    = errors.New("Peer connection closed")
+	errSendQueueFull = errors.New("Peer send queue full")
+	errPayRefused    = errors.New("Peer won't give out another address until one it already gave us is paid")
+)
+
+// messages are sent as frames, each consisting of a header holding the message
+// type and the length of the payload (both big-endian 32-bit integers) followed
+// by the payload itself, a self-contained gob encoding of the NetworkMessage.
+// this lets us refuse oversized messages before reading (or allocating) them
+const frameHeaderLength = 8
+
 type PeerConn struct {
 	base    net.Conn
-	encoder *gob.Encoder
-	decoder *gob.Decoder
+	nodeID  uint64
+	reader  *bufio.Reader
+	limiter *RateLimiter
+
+	out     chan *NetworkMessage
+	closed  bool
+	latency time.Duration // round-trip time of the most recent ping, 0 if unknown
+	lock    sync.Mutex
 }
 
 func NewPeerConn(conn net.Conn) *PeerConn {
-	return &PeerConn{conn, gob.NewEncoder(conn), gob.NewDecoder(conn)}
+	peer := &PeerConn{
+		base:    conn,
+		reader:  bufio.NewReader(conn),
+		limiter: NewRateLimiter(),
+		out:     make(chan *NetworkMessage, sendQueueLength),
+	}
+	go peer.writeLoop()
+	return peer
 }
 
+// queues msg to be sent to the peer, never blocking; if the peer isn't keeping
+// up with the messages we send it, it is disconnected
 func (peer *PeerConn) Send(msg *NetworkMessage) error {
-	err := peer.encoder.Encode(msg)
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
 
-	if err == nil {
-		return nil
+	if peer.closed {
+		return errPeerClosed
 	}
 
-	switch err.(type) {
-	case net.Error:
-		// caller may choose to ignore this
-		return err
+	if (msg.Type == BlockBroadcast || msg.Type == TransactionBroadcast) && len(peer.out) >= cap(peer.out)/2 {
+		return errSendQueueFull
+	}
+
+	select {
+	case peer.out <- msg:
+		return nil
 	default:
-		// probably a gob error which we want to know about
-		panic(err)
+		logger.Println("Peer too slow, disconnecting:", peer.base.RemoteAddr())
+		peer.drop()
+		return errSendQueueFull
 	}
 }
 
+// closes the connection once everything already queued has been sent
+func (peer *PeerConn) Close() {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+
+	if !peer.closed {
+		peer.closed = true
+		close(peer.out)
+	}
+}
+
+// closes the connection immediately, discarding anything still queued
+func (peer *PeerConn) Drop() {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+
+	peer.drop()
+}
+
+func (peer *PeerConn) drop() {
+	if !peer.closed {
+		peer.closed = true
+		close(peer.out)
+	}
+	peer.base.Close()
+}
+
+func (peer *PeerConn) writeLoop() {
+	defer peer.base.Close()
+
+	for msg := range peer.out {
+		var buf bytes.Buffer
+		buf.Write(make([]byte, frameHeaderLength))
+		err := gob.NewEncoder(&buf).Encode(msg)
+		if err != nil {
+			// a gob error which we want to know about
+			panic(err)
+		}
+
+		frame := buf.Bytes()
+		binary.BigEndian.PutUint32(frame[0:4], uint32(msg.Type))
+		binary.BigEndian.PutUint32(frame[4:8], uint32(len(frame)-frameHeaderLength))
+
+		peer.base.SetWriteDeadline(time.Now().Add(writeTimeout))
+		_, err = peer.base.Write(frame)
+		if err != nil {
+			// the stream is in an unknown state after a partial write, so
+			// the connection is useless; the receiving goroutine will notice
+			// it has been closed and drop the peer
+			peer.Drop()
+			return
+		}
+	}
+}
+
+func (peer *PeerConn) Latency() time.Duration {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	return peer.latency
+}
+
+func (peer *PeerConn) setLatency(latency time.Duration) {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	peer.latency = latency
+}
+
+// reads the next message from the peer; any error (including the peer sending
+// something malformed or oversized) leaves the connection unusable
 func (peer *PeerConn) Receive() (*NetworkMessage, error) {
-	msg := new(NetworkMessage)
-	err := peer.decoder.Decode(msg)
+	// a peer that goes quiet for too long (we ping them regularly, and they
+	// us) has hung or gone away, so the deadline error drops them
+	peer.base.SetReadDeadline(time.Now().Add(peerTimeout))
 
-	if err == nil {
-		return msg, nil
+	var header [frameHeaderLength]byte
+	_, err := io.ReadFull(peer.reader, header[:])
+	if err != nil {
+		return nil, err
+	}
+
+	msgType := MsgType(binary.BigEndian.Uint32(header[0:4]))
+	length := binary.BigEndian.Uint32(header[4:8])
+	if max, known := maxMsgSize[msgType]; !known || length > max {
+		return nil, errMsgTooLarge
 	}
 
-	switch err.(type) {
-	case net.Error:
-		// caller may choose to ignore this
+	payload := make([]byte, length)
+	_, err = io.ReadFull(peer.reader, payload)
+	if err != nil {
 		return nil, err
-	default:
-		// probably a gob error which we want to know about
-		panic(err)
 	}
+
+	msg := new(NetworkMessage)
+	err = gob.NewDecoder(bytes.NewReader(payload)).Decode(msg)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Type != msgType {
+		return nil, errors.New("Message type does not match frame")
+	}
+
+	return msg, nil
+}
+
+type issuedKey struct {
+	addr Address
+	when time.Time
+}
+
+// PeerNetworkConfig holds everything needed to start a PeerNetwork
+type PeerNetworkConfig struct {
+	Address   string   // to listen on
+	Advertise string   // to tell peers to connect to, defaults to the listening address
+	Seeds     []string // peers to join the network through, leave empty for a new network
+	Book      *AddrBook
+	Identity  *Identity // encrypt and authenticate connections, if not nil
+	Transport Transport
+	State     *State // where received blocks and transactions go
 }
 
 type PeerNetwork struct {
 	peers      map[string]*PeerConn
+	state      *State
+	book       *AddrBook
+	identity   *Identity // nil unless connections are encrypted
+	transport  Transport
 	server     net.Listener
+	advertise  string
+	nodeID     uint64
 	events     chan *NetworkMessage
-	payExpects map[string]chan *rsa.PublicKey
+	payExpects map[string]chan *Address
+	issuedKeys map[uint64][]issuedKey // keys we've given each connected peer to pay to, by node ID
+	listening  bool                   // until AcceptNewConns reports the server closed
 	closing    bool
 	lock       sync.RWMutex
 }
 
-func NewPeerNetwork(address, startPeer string) (network *PeerNetwork, err error) {
-	var peerAddrs []string
+// creates the network, listening on the configured address and joining the
+// network of the first of the seeds that is reachable
+func NewPeerNetwork(config PeerNetworkConfig) (network *PeerNetwork, err error) {
+	book := config.Book
+	network = &PeerNetwork{
+		peers:      make(map[string]*PeerConn),
+		state:      config.State,
+		book:       book,
+		identity:   config.Identity,
+		transport:  config.Transport,
+		nodeID:     rand.Uint64(),
+		payExpects: make(map[string]chan *Address),
+		issuedKeys: make(map[uint64][]issuedKey),
+		events:     make(chan *NetworkMessage),
+	}
+	network.server, err = network.transport.Listen(config.Address)
+	if err != nil {
+		return nil, err
+	}
+	if network.identity != nil {
+		network.server = tls.NewListener(network.server, network.identity.serverConfig())
+	}
+	network.listening = true
+
+	network.advertise = config.Advertise
+	if network.advertise == "" {
+		network.advertise = network.server.Addr().String()
+	}
 
-	if startPeer != "" {
-		conn, err := net.Dial("tcp4", startPeer)
+	// ask each seed for its peers; we only need one of them to answer
+	seeds := config.Seeds
+	var peerAddrs []string
+	for _, seed := range seeds {
+		book.Add(seed)
+		addrs, err := network.requestPeerList(seed)
 		if err != nil {
-			return nil, err
+			logger.Println("Failed to contact seed", seed, err)
+			book.Failed(seed)
+			continue
 		}
-		defer conn.Close()
+		peerAddrs = append(peerAddrs, addrs...)
+	}
+	if len(seeds) > 0 && len(peerAddrs) == 0 {
+		network.server.Close()
+		return nil, errors.New("Could not contact any of the given peers")
+	}
 
-		peer := NewPeerConn(conn)
+	go network.AcceptNewConns()
+	go network.HandleEvents()
+	go network.KeepAlive()
 
-		err = peer.Send(&NetworkMessage{Type: PeerListRequest})
-		if err != nil {
-			return nil, err
-		}
+	for _, addr := range peerAddrs {
+		book.Add(addr)
+		network.connect(addr)
+	}
 
-		msg, err := peer.Receive()
-		if err != nil {
-			return nil, err
-		}
+	go network.Reconnect()
 
-		if msg.Type != PeerListResponse {
-			return nil, errors.New("Received message not a PeerListResponse")
-		}
+	return network, nil
+}
 
-		switch v := msg.Value.(type) {
-		case []string:
-			peerAddrs = v
-		default:
-			return nil, errors.New("Unknown value in PeerListResponse")
-		}
+// connects to addr, completing the encryption handshake (and checking the
+// peer's identity) if necessary
+func (network *PeerNetwork) dial(addr string) (net.Conn, error) {
+	conn, err := network.transport.Dial(addr)
+	if err != nil || network.identity == nil {
+		return conn, err
 	}
 
-	network = &PeerNetwork{
-		peers:      make(map[string]*PeerConn, len(peerAddrs)),
-		payExpects: make(map[string]chan *rsa.PublicKey),
-		events:     make(chan *NetworkMessage),
+	tlsConn := tls.Client(conn, network.identity.clientConfig(addr, network.book))
+	tlsConn.SetDeadline(time.Now().Add(writeTimeout))
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
-	network.server, err = net.Listen("tcp4", address)
+	tlsConn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+// asks the peer at addr (over a temporary connection) for the addresses of all
+// the peers it knows about, including itself
+func (network *PeerNetwork) requestPeerList(addr string) ([]string, error) {
+	conn, err := network.dial(addr)
 	if err != nil {
 		return nil, err
 	}
 
-	go network.AcceptNewConns()
-	go network.HandleEvents()
+	peer := NewPeerConn(conn)
+	defer peer.Drop()
 
-	msg := NetworkMessage{Type: PeerBroadcast, Value: network.server.Addr().String()}
-	for _, addr := range peerAddrs {
-		conn, err := net.Dial("tcp4", addr)
-		if err != nil {
-			continue
+	err = peer.Send(&NetworkMessage{Type: PeerListRequest})
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := peer.Receive()
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Type != PeerListResponse {
+		return nil, errors.New("Received message not a PeerListResponse")
+	}
+
+	addrs, ok := msg.Value.([]string)
+	if !ok {
+		return nil, errors.New("Unknown value in PeerListResponse")
+	}
+
+	// the peer includes its own address in the list, which may need filling in
+	for i := range addrs {
+		addrs[i] = canonicalAddr(addrs[i], conn.RemoteAddr())
+	}
+	return addrs, nil
+}
+
+// opens a permanent connection to the peer at addr, if we don't already have one
+func (network *PeerNetwork) connect(addr string) error {
+	if addr == network.advertise || network.Peer(addr) != nil {
+		return nil
+	}
+
+	conn, err := network.dial(addr)
+	if err != nil {
+		network.book.Failed(addr)
+		return err
+	}
+
+	peer := NewPeerConn(conn)
+
+	// we each tell the other who we are and where we're listening
+	err = peer.Send(&NetworkMessage{Type: PeerBroadcast, Value: network.hello()})
+	var msg *NetworkMessage
+	if err == nil {
+		msg, err = peer.Receive()
+	}
+	if err != nil {
+		peer.Drop()
+		network.book.Failed(addr)
+		return err
+	}
+
+	hello, ok := msg.Value.(PeerHello)
+	if msg.Type != PeerBroadcast || !ok {
+		peer.Drop()
+		network.book.Failed(addr)
+		return errors.New("Received message not a PeerBroadcast")
+	}
+
+	if hello.NodeID == network.nodeID {
+		logger.Println("Address is our own, forgetting it:", addr)
+		peer.Drop()
+		network.book.Remove(addr)
+		return nil
+	}
+
+	canonical := canonicalAddr(hello.Addr, conn.RemoteAddr())
+	if canonical != addr {
+		// we know them by the address they listen on, not the one we used, and
+		// the identity we pinned when dialing goes with them
+		logger.Println("Peer at", addr, "is listening on", canonical)
+		if !network.book.Move(addr, canonical) {
+			peer.Drop()
+			network.book.Failed(addr)
+			return errors.New("Peer identity does not match the one pinned for " + canonical)
+		}
+	}
+
+	if network.register(canonical, hello.NodeID, peer) {
+		logger.Println("Connected to peer:", canonical)
+	} else {
+		peer.Drop()
+	}
+
+	return nil
+}
+
+// adds a newly connected peer, unless it is already connected (possibly via a
+// different address); returns true if it was added
+func (network *PeerNetwork) register(addr string, nodeID uint64, peer *PeerConn) bool {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+
+	if network.closing || network.peers[addr] != nil {
+		return false
+	}
+	for _, other := range network.peers {
+		if other.nodeID == nodeID {
+			return false
 		}
+	}
+
+	peer.nodeID = nodeID
+	network.peers[addr] = peer
+	go network.ReceiveFromConn(addr, peer)
+	network.book.Seen(addr)
+
+	return true
+}
 
-		peer := NewPeerConn(conn)
+func (network *PeerNetwork) hello() PeerHello {
+	return PeerHello{network.advertise, network.nodeID}
+}
+
+// peers tell us the address they are listening on, but if they are listening on
+// all interfaces (eg ":1234" or "[::]:1234") then that's no use to anyone else,
+// so fill in the host they actually connected to us from
+func canonicalAddr(advertised string, observed net.Addr) string {
+	host, port, err := net.SplitHostPort(advertised)
+	if err != nil {
+		return advertised // not a host:port address, eg an in-memory one
+	}
 
-		err = peer.Send(&msg)
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		observedHost, _, err := net.SplitHostPort(observed.String())
 		if err != nil {
-			conn.Close()
-			continue
+			return advertised
 		}
-
-		network.peers[addr] = peer
-		go network.ReceiveFromConn(addr)
+		host = observedHost
 	}
 
-	return network, nil
+	return net.JoinHostPort(host, port)
 }
 
 func (network *PeerNetwork) AcceptNewConns() {
@@ -168,56 +499,78 @@ func (network *PeerNetwork) AcceptNewConns() {
 			return
 		}
 
-		peer := NewPeerConn(conn)
+		// handshake in the background so a slow peer can't hold up the others
+		go network.handshake(NewPeerConn(conn))
+	}
+}
 
-		msg, err := peer.Receive()
-		if err != nil {
-			conn.Close()
-			continue
+func (network *PeerNetwork) handshake(peer *PeerConn) {
+	msg, err := peer.Receive()
+	if err != nil {
+		peer.Drop()
+		return
+	}
+
+	switch msg.Type {
+	case PeerListRequest:
+		response := NetworkMessage{Type: PeerListResponse, Value: append(network.PeerAddrList(), network.advertise)}
+		peer.Send(&response)
+		peer.Close()
+	case PeerBroadcast:
+		hello, ok := msg.Value.(PeerHello)
+		if !ok {
+			peer.Drop()
+			return
+		}
+		addr := canonicalAddr(hello.Addr, peer.base.RemoteAddr())
+
+		// always answer, so the other side can tell if it reached itself or
+		// a peer it is already connected to; if we then don't want the
+		// connection, close it gracefully so they get the answer
+		peer.Send(&NetworkMessage{Type: PeerBroadcast, Value: network.hello()})
+		if hello.NodeID == network.nodeID {
+			peer.Close()
+			return
 		}
 
-		switch msg.Type {
-		case PeerListRequest:
-			response := NetworkMessage{Type: PeerListResponse, Value: append(network.PeerAddrList(), network.server.Addr().String())}
-			peer.Send(&response)
-			conn.Close()
-		case PeerBroadcast:
-			switch addr := msg.Value.(type) {
-			case string:
-				network.lock.Lock()
-				if !network.closing && network.peers[addr] == nil {
-					network.peers[addr] = peer
-					go network.ReceiveFromConn(addr)
-					logger.Println("New peer:", addr)
-				} else {
-					conn.Close()
-				}
-				network.lock.Unlock()
-			default:
-				conn.Close()
-			}
-		default:
-			conn.Close()
+		// the encryption handshake already happened during Receive, so we know
+		// who they are; make sure it's who has been at that address before. The
+		// address is only what they say it is, so it's pinned when we dial it
+		// ourselves (see clientConfig), never here
+		if network.identity != nil && !network.book.Matches(addr, peerFingerprint(peer.base)) {
+			logger.Println("Peer identity does not match the one pinned for", addr)
+			peer.Drop()
+			return
 		}
+
+		if network.register(addr, hello.NodeID, peer) {
+			logger.Println("New peer:", addr)
+		} else {
+			peer.Close()
+		}
+	default:
+		peer.Drop()
 	}
 }
 
-func (network *PeerNetwork) ReceiveFromConn(addr string) {
-	peer := network.peers[addr]
-
-	var err error
-	var msg NetworkMessage
-
+func (network *PeerNetwork) ReceiveFromConn(addr string, peer *PeerConn) {
 	for {
-		err = peer.decoder.Decode(&msg)
+		// a fresh message each time, since the previous one may still be in use
+		// by HandleEvents (especially if it is being relayed)
+		msg, err := peer.Receive()
 		if err != nil {
 			network.events <- &NetworkMessage{Error, err, addr}
 			return
 		}
 
+		if !peer.limiter.Allow(msg.Type) {
+			logger.Println("Rate limit exceeded, ignoring message from", addr)
+			continue
+		}
+
 		msg.addr = addr
 
-		network.events <- &msg
+		network.events <- msg
 	}
 }
 
@@ -226,7 +579,7 @@ func (network *PeerNetwork) HandleEvents() {
 		switch msg.Type {
 		case BlockChainRequest:
 			hash := msg.Value.([]byte)
-			chain := state.ChainFromHash(hash)
+			chain := network.state.ChainFromHash(hash)
 			if chain != nil {
 				message := NetworkMessage{Type: BlockChainResponse, Value: chain}
 				peer := network.Peer(msg.addr)
@@ -235,26 +588,42 @@ func (network *PeerNetwork) HandleEvents() {
 		case BlockChainResponse:
 			chain := msg.Value.(BlockChain)
 			logger.Println("Received blockchain from", msg.addr)
-			state.AddBlockChain(&chain)
-		case BlockBroadcast:
+			if network.state.AddBlockChain(&chain) {
+				// let our other peers know about the new tip; any that
+				// don't have the chain will request it from us
+				network.relay(&NetworkMessage{Type: BlockBroadcast, Value: chain.Last()}, msg.addr)
+			}
+		case BlockBroadcast, BlockResponse:
 			logger.Println("Received block from", msg.addr)
 			block := msg.Value.(Block)
-			valid, haveChain := state.AddBlock(&block)
-			if valid && !haveChain {
-				network.RequestBlockChain(msg.addr, block.Hash())
+			network.receiveBlock(&block, msg.addr)
+		case BlockRequest:
+			hash, ok := msg.Value.([]byte)
+			if !ok {
+				network.dropMalformed(msg)
+				break
+			}
+			block := network.state.Block(hash)
+			peer := network.Peer(msg.addr)
+			if block != nil && peer != nil {
+				peer.Send(&NetworkMessage{Type: BlockResponse, Value: block})
 			}
 		case TransactionRequest:
-			key := genKey()
-			message := NetworkMessage{Type: TransactionResponse, Value: key.PublicKey}
 			peer := network.Peer(msg.addr)
-			peer.Send(&message)
-			state.AddToWallet(key)
+			if peer != nil {
+				payTo := network.payableAddress(msg.addr, peer)
+				peer.Send(&NetworkMessage{Type: TransactionResponse, Value: payTo})
+			}
 		case TransactionResponse:
+			payTo, ok := msg.Value.(Address)
+			if !ok {
+				network.dropMalformed(msg)
+				break
+			}
 			network.lock.Lock()
 			expect := network.payExpects[msg.addr]
 			if expect != nil {
-				key := msg.Value.(rsa.PublicKey)
-				expect <- &key
+				expect <- &payTo
 				close(expect)
 				delete(network.payExpects, msg.addr)
 			}
@@ -262,37 +631,182 @@ func (network *PeerNetwork) HandleEvents() {
 		case TransactionBroadcast:
 			logger.Println("Received txn from", msg.addr)
 			txn := msg.Value.(Transaction)
-			state.AddTxn(&txn)
+			// a txn that we were missing the parent of is relayed once the
+			// parent arrives, along with the parent
+			for _, added := range network.state.AcceptTxn(&txn) {
+				network.relay(&NetworkMessage{Type: TransactionBroadcast, Value: added}, msg.addr)
+			}
+		case Ping:
+			peer := network.Peer(msg.addr)
+			if peer != nil {
+				peer.Send(&NetworkMessage{Type: Pong, Value: msg.Value})
+			}
+		case Pong:
+			nanos, ok := msg.Value.(int64)
+			if !ok {
+				network.dropMalformed(msg)
+				break
+			}
+			peer := network.Peer(msg.addr)
+			if peer != nil {
+				peer.setLatency(time.Since(time.Unix(0, nanos)))
+			}
 		case Error:
 			if msg.addr == "" {
-				if network.closing {
-					if len(network.peers) == 0 {
-						close(network.events)
-						return
-					}
-				} else {
+				if !network.closing {
 					panic(msg.Value)
 				}
+				network.listening = false
+				if len(network.peers) == 0 {
+					return
+				}
 			} else {
 				network.lock.Lock()
+				if peer := network.peers[msg.addr]; peer != nil {
+					delete(network.issuedKeys, peer.nodeID)
+				}
 				delete(network.peers, msg.addr)
+				if expect := network.payExpects[msg.addr]; expect != nil {
+					// nobody is going to answer this now
+					close(expect)
+					delete(network.payExpects, msg.addr)
+				}
 				network.lock.Unlock()
-				logger.Println("Lost peer:", msg.addr)
+				logger.Println("Lost peer:", msg.addr, msg.Value)
 				if len(network.peers) == 0 {
-					if network.closing {
-						close(network.events)
+					if network.closing && !network.listening {
+						// nothing is left that could send us events
 						return
-					} else if msg.Value != io.EOF {
-						panic(msg.Value)
 					}
+					// Reconnect will keep trying to get us back into the network
+					logger.Println("Lost connection to all peers")
 				}
 			}
 		default:
-			panic(msg.Type)
+			logger.Println("Ignoring unexpected message from", msg.addr, msg.Type)
 		}
 	}
 }
 
+// drops the peer that sent msg, whose value isn't what its type says it should be
+func (network *PeerNetwork) dropMalformed(msg *NetworkMessage) {
+	logger.Println("Dropping", msg.addr, "for sending a malformed message of type", msg.Type)
+	if peer := network.Peer(msg.addr); peer != nil {
+		peer.Drop()
+	}
+}
+
+// pings all our peers every pingInterval; this both measures their latency and
+// makes sure that they have something to read so they don't time us out
+func (network *PeerNetwork) KeepAlive() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		network.lock.RLock()
+		if network.closing {
+			network.lock.RUnlock()
+			return
+		}
+		peers := make([]*PeerConn, 0, len(network.peers))
+		for _, peer := range network.peers {
+			peers = append(peers, peer)
+		}
+		network.lock.RUnlock()
+
+		for _, peer := range peers {
+			peer.Send(&NetworkMessage{Type: Ping, Value: time.Now().UnixNano()})
+		}
+	}
+}
+
+// periodically tries to connect to every peer in our address book that we
+// aren't already connected to (subject to backoff), so that we recover from
+// dropped connections and network partitions
+func (network *PeerNetwork) Reconnect() {
+	for {
+		// jitter, so two peers that lost each other don't keep trying to
+		// reconnect at the same moment and rejecting each other's connections
+		time.Sleep(minBackoff + time.Duration(rand.Int63n(int64(minBackoff))))
+
+		network.lock.RLock()
+		closing := network.closing
+		network.lock.RUnlock()
+		if closing {
+			return
+		}
+
+		connected := network.PeerAddrList()
+		network.book.Seen(connected...)
+
+		for _, addr := range network.book.Candidates() {
+			if network.Peer(addr) != nil {
+				continue
+			}
+			if network.connect(addr) == nil && network.Peer(addr) != nil {
+				// we may have missed blocks while disconnected (and so may
+				// they), and the peer may know about peers that we don't
+				network.RequestBlockChain(addr, nil)
+				if peer, tip := network.Peer(addr), network.state.Tip(); peer != nil && tip != nil {
+					peer.Send(&NetworkMessage{Type: BlockBroadcast, Value: tip})
+				}
+				if addrs, err := network.requestPeerList(addr); err == nil {
+					for _, addr := range addrs {
+						if addr != network.advertise {
+							network.book.Add(addr)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// adds a block from the peer at addr, relaying it (and any orphans it connected)
+// on to our other peers, or asking the peer for its missing ancestors
+func (network *PeerNetwork) receiveBlock(block *Block, addr string) {
+	if network.state.HasBlock(block.Hash()) {
+		return // we've seen it already, don't relay it again
+	}
+
+	connected, missing, depth := network.state.AddBlock(block)
+	if missing != nil {
+		if depth < maxBlockRequests {
+			network.RequestBlock(addr, missing)
+		} else {
+			// we're a long way behind, so it's quicker to get the whole chain
+			network.RequestBlockChain(addr, block.Hash())
+		}
+	}
+	for _, b := range connected {
+		network.relay(&NetworkMessage{Type: BlockBroadcast, Value: b}, addr)
+	}
+}
+
+// returns a new key for the peer at addr to pay us with, or the zero address if
+// the peer already has too many that it hasn't used. the peer is known by its
+// node ID, so it can't get a fresh allowance by claiming a different address.
+// only called by HandleEvents
+func (network *PeerNetwork) payableAddress(addr string, peer *PeerConn) Address {
+	var outstanding []issuedKey
+	for _, issued := range network.issuedKeys[peer.nodeID] {
+		if time.Since(issued.when) < keyExpiry && !network.state.AddressFunded(issued.addr) {
+			outstanding = append(outstanding, issued)
+		}
+	}
+
+	network.issuedKeys[peer.nodeID] = outstanding
+	if len(outstanding) >= maxOutstandingKeys {
+		logger.Println("Refusing payment key to", addr)
+		return Address{}
+	}
+
+	key := network.state.NewKey(branchReceive)
+	payTo := AddressOf(&key.PublicKey)
+	network.issuedKeys[peer.nodeID] = append(outstanding, issuedKey{payTo, time.Now()})
+	return payTo
+}
+
 func (network *PeerNetwork) Close() {
 	network.lock.Lock()
 	defer network.lock.Unlock()
@@ -300,7 +814,7 @@ func (network *PeerNetwork) Close() {
 	network.closing = true
 	network.server.Close()
 	for _, peer := range network.peers {
-		peer.base.Close()
+		peer.Drop()
 	}
 }
 
@@ -315,6 +829,28 @@ func (network *PeerNetwork) PeerAddrList() []string {
 	return list
 }
 
+// the address peers should use to connect to us
+func (network *PeerNetwork) Addr() string {
+	return network.advertise
+}
+
+type PeerStatus struct {
+	Remote  string        // the address the connection actually comes from
+	Latency time.Duration // the most recently measured round-trip time
+}
+
+// returns the status of each peer, by the address it is listening on
+func (network *PeerNetwork) PeerStatuses() map[string]PeerStatus {
+	network.lock.RLock()
+	defer network.lock.RUnlock()
+
+	statuses := make(map[string]PeerStatus, len(network.peers))
+	for addr, peer := range network.peers {
+		statuses[addr] = PeerStatus{peer.base.RemoteAddr().String(), peer.Latency()}
+	}
+	return statuses
+}
+
 func (network *PeerNetwork) Peer(addr string) *PeerConn {
 	network.lock.RLock()
 	defer network.lock.RUnlock()
@@ -334,20 +870,27 @@ func (network *PeerNetwork) CancelPayExpectation(addr string) {
 	network.lock.Lock()
 	defer network.lock.Unlock()
 
-	close(network.payExpects[addr])
-	delete(network.payExpects, addr)
+	// the expectation may already have been fulfilled or cancelled
+	if expect := network.payExpects[addr]; expect != nil {
+		close(expect)
+		delete(network.payExpects, addr)
+	}
 }
 
-func (network *PeerNetwork) genPayExpectation(addr string) chan *rsa.PublicKey {
+func (network *PeerNetwork) genPayExpectation(addr string) chan *Address {
 	network.lock.Lock()
 	defer network.lock.Unlock()
 
-	c := make(chan *rsa.PublicKey)
+	// buffered so that HandleEvents never blocks (while holding the lock) on a
+	// payer who has given up waiting
+	c := make(chan *Address, 1)
 	network.payExpects[addr] = c
 	return c
 }
 
-func (network *PeerNetwork) RequestPayableAddress(addr string) (chan *rsa.PublicKey, error) {
+// asks the peer at addr for an address to pay. The channel gets nil if the peer
+// disconnects first, or the zero address if it refuses (see maxOutstandingKeys)
+func (network *PeerNetwork) RequestPayableAddress(addr string) (chan *Address, error) {
 	peer := network.Peer(addr)
 
 	if peer == nil {
@@ -379,28 +922,49 @@ func (network *PeerNetwork) RequestBlockChain(addr string, hash []byte) {
 	peer.Send(&message)
 }
 
+// asks the peer at addr for the single block with the given hash
+func (network *PeerNetwork) RequestBlock(addr string, hash []byte) {
+	peer := network.Peer(addr)
+
+	if peer == nil {
+		return
+	}
+
+	message := NetworkMessage{Type: BlockRequest, Value: hash}
+	peer.Send(&message)
+}
+
 func (network *PeerNetwork) BroadcastBlock(b *Block) {
 	message := NetworkMessage{Type: BlockBroadcast, Value: b}
-	go network.broadcast(&message)
+	network.broadcast(&message)
 }
 
 func (network *PeerNetwork) BroadcastTxn(txn *Transaction) {
 	message := NetworkMessage{Type: TransactionBroadcast, Value: txn}
-	go network.broadcast(&message)
+	network.broadcast(&message)
+}
+
+// forwards a message we received from the peer at addr on to all our other peers
+func (network *PeerNetwork) relay(msg *NetworkMessage, addr string) {
+	network.broadcastExcept(msg, addr)
 }
 
 func (network *PeerNetwork) broadcast(msg *NetworkMessage) {
-	if *delay {
-		time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
-	}
+	network.broadcastExcept(msg, "")
+}
+
+func (network *PeerNetwork) broadcastExcept(msg *NetworkMessage, except string) {
 	network.lock.RLock()
-	defer network.lock.RUnlock()
+	peers := make([]*PeerConn, 0, len(network.peers))
+	for addr, peer := range network.peers {
+		if addr != except {
+			peers = append(peers, peer)
+		}
+	}
+	network.lock.RUnlock()
 
 	// send to all peers
-	for _, peer := range network.peers {
+	for _, peer := range peers {
 		peer.Send(msg)
-		if *delay {
-			time.Sleep(time.Duration(rand.Intn(1000)) * time.Millisecond)
-		}
 	}
 }
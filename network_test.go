@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// how long a test waits for something to spread through the network
+const testSettleTime = 30 * time.Second
+
+type testNode struct {
+	name    string
+	state   *State
+	network *PeerNetwork
+}
+
+// starts count peers on mn, each joining via the one before it
+func startTestNodes(t *testing.T, mn *MemNetwork, count int) []*testNode {
+	var nodes []*testNode
+	for i := 0; i < count; i++ {
+		node := &testNode{name: "n" + strconv.Itoa(i), state: NewState()}
+		var seeds []string
+		if i > 0 {
+			seeds = []string{nodes[i-1].name}
+		}
+
+		book, _ := LoadAddrBook("")
+		network, err := NewPeerNetwork(PeerNetworkConfig{
+			Address:   node.name,
+			Seeds:     seeds,
+			Book:      book,
+			Transport: mn.Transport(node.name),
+			State:     node.state,
+		})
+		if err != nil {
+			t.Fatalf("starting %s: %v", node.name, err)
+		}
+		node.network = network
+		t.Cleanup(network.Close)
+		nodes = append(nodes, node)
+	}
+
+	waitFor(t, "every node to have a peer", func() bool {
+		for _, node := range nodes {
+			if len(node.network.PeerAddrList()) == 0 {
+				return false
+			}
+		}
+		return true
+	})
+	return nodes
+}
+
+// fails the test if cond doesn't become true within testSettleTime
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testSettleTime)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func mineTestBlock(node *testNode) *Block {
+	mineBlock(node.state, node.network, rand.New(rand.NewSource(time.Now().UnixNano())), nil)
+	return node.state.Tip()
+}
+
+// returns true if every node has tip as its chain tip
+func haveTip(nodes []*testNode, tip *Block) bool {
+	for _, node := range nodes {
+		nodeTip := node.state.Tip()
+		if nodeTip == nil || !bytes.Equal(nodeTip.Hash(), tip.Hash()) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBlockRelay(t *testing.T) {
+	mn := NewMemNetwork(1)
+	mn.SetLatency(5*time.Millisecond, 5*time.Millisecond)
+	nodes := startTestNodes(t, mn, 5)
+
+	for i := 0; i < 2; i++ {
+		tip := mineTestBlock(nodes[i])
+		waitFor(t, "the block to reach every node", func() bool { return haveTip(nodes, tip) })
+	}
+	for _, node := range nodes {
+		if node.state.Height() != 2 {
+			t.Errorf("%s has height %d, want 2", node.name, node.state.Height())
+		}
+	}
+}
+
+func TestTxnRelay(t *testing.T) {
+	mn := NewMemNetwork(2)
+	mn.SetLatency(5*time.Millisecond, 5*time.Millisecond)
+	nodes := startTestNodes(t, mn, 4)
+	payer, payee := nodes[0], nodes[len(nodes)-1]
+
+	tip := mineTestBlock(payer)
+	waitFor(t, "the block to reach every node", func() bool { return haveTip(nodes, tip) })
+
+	coins := payer.state.WalletCoins()
+	if len(coins) != 1 {
+		t.Fatalf("miner has %d coins, want 1", len(coins))
+	}
+	key := payee.state.NewKey(branchReceive)
+	txn := &Transaction{
+		Inputs:  []TxnInput{payer.state.GenTxnInput(coins[0].Address)},
+		Outputs: []TxnOutput{{AddressOf(&key.PublicKey), coins[0].Amount - 1}},
+	}
+	if err := payer.state.Sign(txn); err != nil {
+		t.Fatal(err)
+	}
+	if !payer.state.AddTxn(txn) {
+		t.Fatal("payer's own mempool refused the txn")
+	}
+	payer.network.BroadcastTxn(txn)
+	hash := txn.Hash()
+
+	inMempool := func(node *testNode) bool {
+		for _, entry := range node.state.MempoolEntries() {
+			if bytes.Equal(entry.Hash, hash) {
+				return true
+			}
+		}
+		return false
+	}
+	waitFor(t, "the txn to reach every mempool", func() bool {
+		for _, node := range nodes {
+			if !inMempool(node) {
+				return false
+			}
+		}
+		return true
+	})
+
+	// whoever mines next includes it, and the payee sees the coins
+	tip = mineTestBlock(nodes[1])
+	waitFor(t, "the block to reach every node", func() bool { return haveTip(nodes, tip) })
+	if got := payee.state.GetWallet()[AddressOf(&key.PublicKey)]; got != coins[0].Amount-1 {
+		t.Errorf("payee has %d coins, want %d", got, coins[0].Amount-1)
+	}
+	if inMempool(payee) {
+		t.Error("mined txn is still in the mempool")
+	}
+}
+
+func TestPartition(t *testing.T) {
+	mn := NewMemNetwork(3)
+	mn.SetLatency(5*time.Millisecond, 5*time.Millisecond)
+	nodes := startTestNodes(t, mn, 4)
+	left, right := nodes[:2], nodes[2:]
+
+	mn.Partition([]string{"n0", "n1"}, []string{"n2", "n3"})
+	leftTip := mineTestBlock(left[0])
+	rightTip := mineTestBlock(right[1])
+	waitFor(t, "each side to agree on its own block", func() bool {
+		return haveTip(left, leftTip) && haveTip(right, rightTip)
+	})
+
+	// nothing should have got across
+	time.Sleep(200 * time.Millisecond)
+	if !haveTip(left, leftTip) || !haveTip(right, rightTip) {
+		t.Fatal("a block crossed the partition")
+	}
+
+	// once healed, the next block makes one side's chain the longest, and the
+	// other side fetches what it missed and switches over to it
+	mn.Heal()
+	tip := mineTestBlock(right[0])
+	waitFor(t, "every node to switch to the longest chain", func() bool { return haveTip(nodes, tip) })
+	for _, node := range left {
+		if node.state.Height() != 2 {
+			t.Errorf("%s has height %d, want 2", node.name, node.state.Height())
+		}
+	}
+}
+
+// connects to the node at addr as a peer called name, without running a network
+func rawPeer(t *testing.T, mn *MemNetwork, name, addr string) *PeerConn {
+	conn, err := mn.Transport(name).Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := NewPeerConn(conn)
+	t.Cleanup(peer.Drop)
+
+	peer.Send(&NetworkMessage{Type: PeerBroadcast, Value: PeerHello{name, rand.Uint64()}})
+	if msg, err := peer.Receive(); err != nil || msg.Type != PeerBroadcast {
+		t.Fatalf("no hello from %s: %v", addr, err)
+	}
+	return peer
+}
+
+func TestMalformedMessages(t *testing.T) {
+	mn := NewMemNetwork(4)
+	nodes := startTestNodes(t, mn, 2)
+
+	tests := []struct {
+		name string
+		msg  NetworkMessage
+	}{
+		{"pong without a time", NetworkMessage{Type: Pong}},
+		{"pong with a string", NetworkMessage{Type: Pong, Value: "soon"}},
+		{"block request without a hash", NetworkMessage{Type: BlockRequest}},
+		{"block request with a number", NetworkMessage{Type: BlockRequest, Value: 7}},
+		{"address without an address", NetworkMessage{Type: TransactionResponse}},
+	}
+
+	for i, test := range tests {
+		name := "bad" + strconv.Itoa(i)
+		peer := rawPeer(t, mn, name, "n0")
+
+		// an address is only looked at if we asked for one
+		var expect chan *Address
+		if test.msg.Type == TransactionResponse {
+			waitFor(t, "the node to add the peer", func() bool { return nodes[0].network.Peer(name) != nil })
+			var err error
+			if expect, err = nodes[0].network.RequestPayableAddress(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		peer.Send(&test.msg)
+
+		// the node should hang up on us, and carry on as normal
+		for {
+			if _, err := peer.Receive(); err != nil {
+				break
+			}
+		}
+		if expect != nil {
+			if payTo := <-expect; payTo != nil {
+				t.Errorf("%s: got address %s", test.name, payTo)
+			}
+		}
+		tip := mineTestBlock(nodes[1])
+		waitFor(t, "the network to carry on after "+test.name, func() bool { return haveTip(nodes, tip) })
+	}
+}
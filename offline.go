@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+const partialTxnVersion = 1
+
+// PartialTxn is a transaction on its way from being created (by a peer that can
+// see the coins being spent, eg one watching the addresses) to being signed (by
+// a peer holding the keys, which may be offline) and then broadcast. It is kept
+// in a file as JSON, so it can be moved between peers by hand and checked by
+// eye, and doesn't depend on how either peer encodes its types
+type PartialTxn struct {
+	Version int             `json:"version"`
+	Inputs  []PartialInput  `json:"inputs"`
+	Outputs []PartialOutput `json:"outputs"`
+}
+
+type PartialInput struct {
+	Key       string `json:"key"`       // as shown by receive, eg "ed25519:ab12..."
+	PrevHash  string `json:"prev_hash"` // hex
+	Amount    uint64 `json:"amount"`    // what the creator says it spends, checked against Prev
+	Signature string `json:"signature,omitempty"`
+
+	// the txn being spent from, so that a signer without the blockchain can
+	// check that it has the hash prev_hash and pays amount to key
+	Prev *PrevTxn `json:"prev,omitempty"`
+}
+
+// PrevTxn is as much of a transaction as it takes to work out its hash, which
+// doesn't cover the signatures
+type PrevTxn struct {
+	Inputs  []PrevInput     `json:"inputs"`
+	Outputs []PartialOutput `json:"outputs"`
+}
+
+type PrevInput struct {
+	Key      string `json:"key"`
+	PrevHash string `json:"prev_hash"`
+}
+
+type PartialOutput struct {
+	Address string `json:"address"`
+	Amount  uint64 `json:"amount"`
+}
+
+// makes the portable form of txn, where prevs are the transactions its inputs
+// spend from
+func NewPartialTxn(txn *Transaction, prevs []*Transaction) *PartialTxn {
+	partial := &PartialTxn{Version: partialTxnVersion}
+	for i, input := range txn.Inputs {
+		_, amount := prevs[i].OutputAmount(AddressOf(&input.Key))
+		partial.Inputs = append(partial.Inputs, PartialInput{
+			Key:       input.Key.String(),
+			PrevHash:  hex.EncodeToString(input.PrevHash),
+			Amount:    amount,
+			Signature: hex.EncodeToString(input.Signature),
+			Prev:      newPrevTxn(prevs[i]),
+		})
+	}
+	partial.Outputs = partialOutputs(txn)
+	return partial
+}
+
+func newPrevTxn(txn *Transaction) *PrevTxn {
+	prev := &PrevTxn{Outputs: partialOutputs(txn)}
+	for _, input := range txn.Inputs {
+		prev.Inputs = append(prev.Inputs, PrevInput{input.Key.String(), hex.EncodeToString(input.PrevHash)})
+	}
+	return prev
+}
+
+func partialOutputs(txn *Transaction) []PartialOutput {
+	var outputs []PartialOutput
+	for _, output := range txn.Outputs {
+		outputs = append(outputs, PartialOutput{output.Address.String(), output.Amount})
+	}
+	return outputs
+}
+
+// rebuilds the transaction, with the signatures made so far
+func (partial *PartialTxn) Transaction() (*Transaction, error) {
+	if partial.Version != partialTxnVersion {
+		return nil, fmt.Errorf("Unsupported partially-signed txn version %d", partial.Version)
+	}
+	if len(partial.Inputs) == 0 || len(partial.Outputs) == 0 {
+		return nil, errors.New("Partially-signed txn has no inputs or no outputs")
+	}
+
+	txn := new(Transaction)
+	for i, in := range partial.Inputs {
+		input, err := parseInput(in.Key, in.PrevHash)
+		if err != nil {
+			return nil, fmt.Errorf("Input %d: %v", i+1, err)
+		}
+		if input.Signature, err = hex.DecodeString(in.Signature); err != nil {
+			return nil, fmt.Errorf("Input %d: bad signature", i+1)
+		}
+		if len(input.Signature) == 0 {
+			input.Signature = nil
+		}
+		txn.Inputs = append(txn.Inputs, input)
+	}
+	var err error
+	if txn.Outputs, err = parseOutputs(partial.Outputs); err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+// rebuilds the transaction, without its signatures
+func (prev *PrevTxn) Transaction() (*Transaction, error) {
+	txn := new(Transaction)
+	for i, in := range prev.Inputs {
+		input, err := parseInput(in.Key, in.PrevHash)
+		if err != nil {
+			return nil, fmt.Errorf("Input %d: %v", i+1, err)
+		}
+		txn.Inputs = append(txn.Inputs, input)
+	}
+	var err error
+	if txn.Outputs, err = parseOutputs(prev.Outputs); err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+func parseInput(keyString, prevHashString string) (TxnInput, error) {
+	key, err := ParsePublicKey(keyString)
+	if err != nil {
+		return TxnInput{}, err
+	}
+	prevHash, err := hex.DecodeString(prevHashString)
+	if err != nil {
+		return TxnInput{}, errors.New("bad prev_hash")
+	}
+	return TxnInput{*key, prevHash, nil}, nil
+}
+
+func parseOutputs(partials []PartialOutput) ([]TxnOutput, error) {
+	var outputs []TxnOutput
+	for i, out := range partials {
+		addr, err := ParseAddress(out.Address)
+		if err != nil {
+			return nil, fmt.Errorf("Output %d: %v", i+1, err)
+		}
+		outputs = append(outputs, TxnOutput{addr, out.Amount})
+	}
+	return outputs, nil
+}
+
+// returns the amounts the inputs spend, checked against the transactions they
+// spend from, and an error if any of them don't match. An input without its
+// previous transaction can't be checked, so the creator's word is taken for
+// its amount and false is returned
+func (partial *PartialTxn) Amounts() ([]uint64, bool, error) {
+	amounts := make([]uint64, len(partial.Inputs))
+	checked := true
+	for i, in := range partial.Inputs {
+		amounts[i] = in.Amount
+		if in.Prev == nil {
+			checked = false
+			continue
+		}
+
+		input, err := parseInput(in.Key, in.PrevHash)
+		if err != nil {
+			return nil, false, fmt.Errorf("Input %d: %v", i+1, err)
+		}
+		prev, err := in.Prev.Transaction()
+		if err != nil {
+			return nil, false, fmt.Errorf("Input %d's previous txn: %v", i+1, err)
+		}
+		if !bytes.Equal(prev.Hash(), input.PrevHash) {
+			return nil, false, fmt.Errorf("Input %d's previous txn doesn't match its prev_hash", i+1)
+		}
+		exists, amount := prev.OutputAmount(AddressOf(&input.Key))
+		if !exists || amount != in.Amount {
+			return nil, false, fmt.Errorf("Input %d claims to spend %d coins, but its previous txn pays it %d", i+1, in.Amount, amount)
+		}
+	}
+	return amounts, checked, nil
+}
+
+// copies the signatures made so far on txn (which must be the one the file holds)
+// into the file
+func (partial *PartialTxn) SetSignatures(txn *Transaction) {
+	for i, input := range txn.Inputs {
+		partial.Inputs[i].Signature = hex.EncodeToString(input.Signature)
+	}
+}
+
+func ReadPartialTxn(path string) (*PartialTxn, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	partial := new(PartialTxn)
+	if err := json.Unmarshal(data, partial); err != nil {
+		return nil, fmt.Errorf("%s is not a partially-signed txn: %v", path, err)
+	}
+	return partial, nil
+}
+
+func (partial *PartialTxn) Write(path string) error {
+	data, err := json.MarshalIndent(partial, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0600)
+}
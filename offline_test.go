@@ -0,0 +1,87 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// returns an unsigned partial txn spending the whole of one payment, which was
+// itself a signed txn with an input, along with the key that can sign it
+func testPartialTxn(t *testing.T) (*PartialTxn, *PrivateKey) {
+	payer, key := genKey(), genKey()
+	prev := &Transaction{
+		Inputs:  []TxnInput{{payer.PublicKey, make([]byte, 32), nil}},
+		Outputs: []TxnOutput{{AddressOf(&key.PublicKey), 30}, {AddressOf(&genKey().PublicKey), 5}},
+	}
+	if err := prev.Sign(map[Address]*PrivateKey{AddressOf(&payer.PublicKey): payer}); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := &Transaction{
+		Inputs:  []TxnInput{{key.PublicKey, prev.Hash(), nil}},
+		Outputs: []TxnOutput{{AddressOf(&genKey().PublicKey), 29}},
+	}
+	return NewPartialTxn(txn, []*Transaction{prev}), key
+}
+
+func TestPartialTxnAmounts(t *testing.T) {
+	partial, key := testPartialTxn(t)
+
+	path := filepath.Join(t.TempDir(), "txn.json")
+	if err := partial.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	partial, err := ReadPartialTxn(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	amounts, checked, err := partial.Amounts()
+	if err != nil || !checked || len(amounts) != 1 || amounts[0] != 30 {
+		t.Fatalf("got amounts %v, checked %v, error %v; want [30], true, nil", amounts, checked, err)
+	}
+
+	txn, err := partial.Transaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := txn.SignAvailable(map[Address]*PrivateKey{AddressOf(&key.PublicKey): key}); err != nil {
+		t.Fatal(err)
+	}
+	partial.SetSignatures(txn)
+	if txn, err = partial.Transaction(); err != nil || !txn.VerifySignatures() {
+		t.Errorf("signatures don't survive the file: %v", err)
+	}
+}
+
+func TestPartialTxnTampered(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(*PartialTxn)
+		err    string // empty if the amounts should be unchecked but not an error
+	}{
+		{"amount raised", func(p *PartialTxn) { p.Inputs[0].Amount = 40 }, "claims to spend 40 coins"},
+		{"previous txn changed to match", func(p *PartialTxn) {
+			p.Inputs[0].Amount = 40
+			p.Inputs[0].Prev.Outputs[0].Amount = 40
+		}, "doesn't match its prev_hash"},
+		{"previous txn pays someone else", func(p *PartialTxn) {
+			p.Inputs[0].Prev.Outputs = p.Inputs[0].Prev.Outputs[1:]
+		}, "doesn't match its prev_hash"},
+		{"previous txn left out", func(p *PartialTxn) { p.Inputs[0].Prev = nil }, ""},
+	}
+
+	for _, test := range tests {
+		partial, _ := testPartialTxn(t)
+		test.tamper(partial)
+		_, checked, err := partial.Amounts()
+		if test.err == "" {
+			if err != nil || checked {
+				t.Errorf("%s: got checked %v, error %v; want false, nil", test.name, checked, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// how many transactions we hold on to while waiting for their parents,
+	// and for how long
+	orphanMaxTxns = 100
+	orphanExpiry  = 20 * time.Minute
+)
+
+type OrphanEntry struct {
+	Txn     *Transaction
+	Hash    []byte
+	Missing [][]byte // hashes of the parent transactions we haven't seen
+	Added   time.Time
+}
+
+// OrphanPool holds transactions that spend from transactions we don't know about
+// yet (usually because the child was relayed to us before its parent), so that
+// they can be tried again when a missing parent arrives. Like Mempool it is owned
+// by State and must only be used while holding State's lock
+type OrphanPool struct {
+	entries  map[string]*OrphanEntry   // by hash
+	byParent map[string][]*OrphanEntry // by the hash of each missing parent
+	order    []*OrphanEntry
+
+	MaxTxns int
+	Expiry  time.Duration
+}
+
+func NewOrphanPool() *OrphanPool {
+	return &OrphanPool{
+		entries:  make(map[string]*OrphanEntry),
+		byParent: make(map[string][]*OrphanEntry),
+		MaxTxns:  orphanMaxTxns,
+		Expiry:   orphanExpiry,
+	}
+}
+
+func (pool *OrphanPool) Len() int {
+	return len(pool.order)
+}
+
+func (pool *OrphanPool) Get(hash []byte) *OrphanEntry {
+	return pool.entries[string(hash)]
+}
+
+// returns the entries in arrival order
+func (pool *OrphanPool) Entries() []*OrphanEntry {
+	return append([]*OrphanEntry(nil), pool.order...)
+}
+
+// returns the entries waiting on the given parent
+func (pool *OrphanPool) Children(parent []byte) []*OrphanEntry {
+	return append([]*OrphanEntry(nil), pool.byParent[string(parent)]...)
+}
+
+// adds a transaction that is missing the given parents, first making room (by
+// dropping the oldest) if the pool is full
+func (pool *OrphanPool) Add(txn *Transaction, missing [][]byte) *OrphanEntry {
+	entry := &OrphanEntry{txn, txn.Hash(), missing, time.Now()}
+	if pool.Get(entry.Hash) != nil {
+		return pool.Get(entry.Hash)
+	}
+
+	for len(pool.order) >= pool.MaxTxns && len(pool.order) > 0 {
+		logger.Printf("Dropping orphan txn %x", pool.order[0].Hash[:6])
+		pool.Remove(pool.order[0].Hash)
+	}
+
+	pool.entries[string(entry.Hash)] = entry
+	pool.order = append(pool.order, entry)
+	for _, parent := range missing {
+		pool.byParent[string(parent)] = append(pool.byParent[string(parent)], entry)
+	}
+
+	return entry
+}
+
+func (pool *OrphanPool) Remove(hash []byte) {
+	entry := pool.entries[string(hash)]
+	if entry == nil {
+		return
+	}
+	delete(pool.entries, string(hash))
+
+	for i := range pool.order {
+		if pool.order[i] == entry {
+			pool.order = append(pool.order[:i], pool.order[i+1:]...)
+			break
+		}
+	}
+
+	for _, parent := range entry.Missing {
+		siblings := pool.byParent[string(parent)]
+		for i := range siblings {
+			if siblings[i] == entry {
+				siblings = append(siblings[:i], siblings[i+1:]...)
+				break
+			}
+		}
+		if len(siblings) == 0 {
+			delete(pool.byParent, string(parent))
+		} else {
+			pool.byParent[string(parent)] = siblings
+		}
+	}
+}
+
+// removes transactions that have been waiting longer than Expiry
+func (pool *OrphanPool) Expire() {
+	for _, entry := range pool.Entries() {
+		if time.Since(entry.Added) > pool.Expiry {
+			logger.Printf("Expiring orphan txn %x", entry.Hash[:6])
+			pool.Remove(entry.Hash)
+		}
+	}
+}
+
+const (
+	// how many blocks we hold on to while waiting for their ancestors, and for
+	// how long
+	orphanBlockMaxBlocks = 64
+	orphanBlockExpiry    = 10 * time.Minute
+)
+
+type OrphanBlock struct {
+	Block *Block
+	Hash  []byte
+	Added time.Time
+}
+
+// OrphanBlockPool holds blocks whose parent isn't in any of our chains (usually
+// because blocks arrived out of order) until the missing ancestors arrive. Like
+// Mempool it is owned by State and must only be used while holding State's lock
+type OrphanBlockPool struct {
+	entries  map[string]*OrphanBlock   // by hash
+	byParent map[string][]*OrphanBlock // by the hash of the parent
+	order    []*OrphanBlock
+
+	MaxBlocks int
+	Expiry    time.Duration
+}
+
+func NewOrphanBlockPool() *OrphanBlockPool {
+	return &OrphanBlockPool{
+		entries:   make(map[string]*OrphanBlock),
+		byParent:  make(map[string][]*OrphanBlock),
+		MaxBlocks: orphanBlockMaxBlocks,
+		Expiry:    orphanBlockExpiry,
+	}
+}
+
+func (pool *OrphanBlockPool) Len() int {
+	return len(pool.order)
+}
+
+func (pool *OrphanBlockPool) Get(hash []byte) *OrphanBlock {
+	return pool.entries[string(hash)]
+}
+
+// returns the entries in arrival order
+func (pool *OrphanBlockPool) Entries() []*OrphanBlock {
+	return append([]*OrphanBlock(nil), pool.order...)
+}
+
+// returns the entries whose parent is the given block
+func (pool *OrphanBlockPool) Children(parent []byte) []*OrphanBlock {
+	return append([]*OrphanBlock(nil), pool.byParent[string(parent)]...)
+}
+
+// adds a block, first making room (by dropping the oldest) if the pool is full
+func (pool *OrphanBlockPool) Add(b *Block) *OrphanBlock {
+	entry := &OrphanBlock{b, b.Hash(), time.Now()}
+	if pool.Get(entry.Hash) != nil {
+		return pool.Get(entry.Hash)
+	}
+
+	for len(pool.order) >= pool.MaxBlocks && len(pool.order) > 0 {
+		logger.Printf("Dropping orphan block %x", pool.order[0].Hash[:6])
+		pool.Remove(pool.order[0].Hash)
+	}
+
+	pool.entries[string(entry.Hash)] = entry
+	pool.order = append(pool.order, entry)
+	pool.byParent[string(b.PrevHash)] = append(pool.byParent[string(b.PrevHash)], entry)
+
+	return entry
+}
+
+func (pool *OrphanBlockPool) Remove(hash []byte) {
+	entry := pool.entries[string(hash)]
+	if entry == nil {
+		return
+	}
+	delete(pool.entries, string(hash))
+
+	for i := range pool.order {
+		if pool.order[i] == entry {
+			pool.order = append(pool.order[:i], pool.order[i+1:]...)
+			break
+		}
+	}
+
+	parent := string(entry.Block.PrevHash)
+	siblings := pool.byParent[parent]
+	for i := range siblings {
+		if siblings[i] == entry {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(pool.byParent, parent)
+	} else {
+		pool.byParent[parent] = siblings
+	}
+}
+
+// follows the orphan with the given hash back through its orphaned ancestors,
+// returning the hash of the first ancestor that isn't in the pool (which is the
+// one we need to connect them) and how many orphans there are along the way
+func (pool *OrphanBlockPool) Missing(hash []byte) ([]byte, int) {
+	entry := pool.Get(hash)
+	if entry == nil {
+		return nil, 0
+	}
+
+	depth := 1
+	for {
+		parent := pool.Get(entry.Block.PrevHash)
+		if parent == nil {
+			return entry.Block.PrevHash, depth
+		}
+		entry = parent
+		depth++
+	}
+}
+
+// removes blocks that have been waiting longer than Expiry
+func (pool *OrphanBlockPool) Expire() {
+	for _, entry := range pool.Entries() {
+		if time.Since(entry.Added) > pool.Expiry {
+			logger.Printf("Expiring orphan block %x", entry.Hash[:6])
+			pool.Remove(entry.Hash)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// a seed phrase is seedWords words from seedWordList, each standing for one byte:
+// all but the last are the random seed, and the last is a checksum, so that a
+// phrase that was copied down wrong is noticed rather than recovering an empty
+// wallet
+const seedWords = 16
+
+// the derivation branches, so that each kind of key can be recovered without
+// having to guess how many of the others were used
+const (
+	branchReceive = iota // addresses handed out to be paid at
+	branchChange         // change from our own payments
+	branchMining         // mining rewards, indexed by block height
+	numBranches
+)
+
+// how many unused keys beyond the last used one we keep an eye out for on each
+// branch (other than branchMining) when recovering a wallet
+const seedGapLimit = 20
+
+var (
+	errSeedLength   = errors.New("Invalid seed phrase: wrong number of words")
+	errSeedWord     = errors.New("Invalid seed phrase: unknown word")
+	errSeedChecksum = errors.New("Invalid seed phrase: checksum mismatch (typo?)")
+)
+
+// Seed derives all of a deterministic wallet's keys, so that writing down its
+// phrase is enough to back up the wallet however many keys it goes on to use.
+// Keys are derived along the lines of SLIP-0010 (hardened only, since Ed25519
+// keys can't be derived any other way): HMAC-SHA512 splits each key into a
+// child key and a chain code for the next level down, and the keys at the
+// bottom are used as Ed25519 seeds
+type Seed struct {
+	entropy []byte
+
+	branches [numBranches]seedNode
+}
+
+type seedNode struct {
+	key, chain []byte
+}
+
+func (node seedNode) child(index uint32) seedNode {
+	data := append([]byte{0}, node.key...)
+	data = binary.BigEndian.AppendUint32(data, index)
+
+	mac := hmac.New(sha512.New, node.chain)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+	return seedNode{sum[:32], sum[32:]}
+}
+
+// generates a new random seed
+func NewSeed() *Seed {
+	entropy := make([]byte, seedWords-1)
+	if _, err := rand.Read(entropy); err != nil {
+		panic(err)
+	}
+	return newSeed(entropy)
+}
+
+func newSeed(entropy []byte) *Seed {
+	mac := hmac.New(sha512.New, []byte("gocoin seed"))
+	mac.Write(entropy)
+	sum := mac.Sum(nil)
+	master := seedNode{sum[:32], sum[32:]}
+
+	seed := &Seed{entropy: entropy}
+	for i := range seed.branches {
+		seed.branches[i] = master.child(uint32(i))
+	}
+	return seed
+}
+
+// parses and validates a seed phrase (case and spacing don't matter)
+func ParseSeedPhrase(phrase string) (*Seed, error) {
+	words := strings.Fields(strings.ToLower(phrase))
+	if len(words) != seedWords {
+		return nil, errSeedLength
+	}
+
+	data := make([]byte, len(words))
+	for i, word := range words {
+		b, ok := seedWordIndex[word]
+		if !ok {
+			return nil, errSeedWord
+		}
+		data[i] = b
+	}
+
+	entropy := data[:seedWords-1]
+	if seedChecksum(entropy) != data[seedWords-1] {
+		return nil, errSeedChecksum
+	}
+	return newSeed(entropy), nil
+}
+
+func seedChecksum(entropy []byte) byte {
+	sum := sha256.Sum256(entropy)
+	return sum[0]
+}
+
+func (seed *Seed) Phrase() string {
+	words := make([]string, 0, seedWords)
+	for _, b := range seed.entropy {
+		words = append(words, seedWordList[b])
+	}
+	words = append(words, seedWordList[seedChecksum(seed.entropy)])
+	return strings.Join(words, " ")
+}
+
+// returns the key at the given index of the given branch; the same seed always
+// gives the same key
+func (seed *Seed) Key(branch int, index uint32) *PrivateKey {
+	return ed25519Key(seed.branches[branch].child(index).key)
+}
+
+var seedWordList = [256]string{
+	"acid", "acorn", "actor", "adapt", "admit", "adult", "agent", "agree",
+	"ahead", "aim", "air", "alarm", "album", "alert", "alley", "alpha",
+	"amber", "angle", "ankle", "apple", "april", "arena", "argue", "armor",
+	"arrow", "atlas", "atom", "aunt", "autumn", "award", "axis", "baby",
+	"bacon", "badge", "bagel", "baker", "balloon", "bamboo", "banana", "banjo",
+	"barn", "basil", "basket", "beach", "bean", "bear", "beetle", "bell",
+	"bench", "berry", "bike", "bird", "bishop", "blade", "blanket", "blossom",
+	"board", "boat", "bonus", "book", "boot", "bottle", "bounce", "brain",
+	"brave", "bread", "brick", "bridge", "brush", "bubble", "bucket", "buffalo",
+	"bulb", "bundle", "butter", "button", "cabin", "cable", "cactus", "camel",
+	"camera", "candle", "canoe", "canvas", "carbon", "cargo", "carpet", "carrot",
+	"castle", "cattle", "cave", "cedar", "cello", "cereal", "chair", "chalk",
+	"cherry", "chess", "chicken", "chimney", "cider", "cinema", "circle", "citrus",
+	"clam", "clay", "cliff", "clock", "cloud", "clover", "coast", "cobra",
+	"cocoa", "coffee", "comet", "copper", "coral", "cotton", "cousin", "coyote",
+	"crab", "crane", "crayon", "cricket", "crown", "cube", "cupboard", "curtain",
+	"cycle", "daisy", "dance", "delta", "desert", "diamond", "dinner", "doctor",
+	"dolphin", "donkey", "door", "dragon", "drum", "duck", "eagle", "earth",
+	"echo", "eclipse", "elbow", "elephant", "engine", "falcon", "feather", "fence",
+	"fern", "ferry", "fiddle", "finger", "fire", "flag", "flute", "forest",
+	"fossil", "fox", "frog", "garden", "garlic", "gecko", "ghost", "giant",
+	"ginger", "giraffe", "glacier", "glove", "goat", "gold", "gorilla", "grape",
+	"gravel", "guitar", "hammer", "harbor", "harp", "hawk", "hazel", "helmet",
+	"heron", "hill", "honey", "horse", "hotel", "iceberg", "igloo", "island",
+	"ivory", "jacket", "jaguar", "jelly", "jewel", "jungle", "kayak", "kettle",
+	"kidney", "kite", "kitten", "koala", "ladder", "lake", "lamp", "lantern",
+	"lemon", "leopard", "lettuce", "lily", "lion", "lizard", "lobster", "locket",
+	"magnet", "mango", "maple", "marble", "meadow", "melon", "mirror", "monkey",
+	"moon", "moose", "mountain", "mouse", "muffin", "mushroom", "napkin", "needle",
+	"nest", "noodle", "oak", "ocean", "olive", "onion", "orange", "orbit",
+	"otter", "owl", "oyster", "paddle", "panda", "paper", "parrot", "peach",
+	"peanut", "pebble", "pelican", "pencil", "pepper", "piano", "pigeon", "pillow",
+}
+
+var seedWordIndex = func() map[string]byte {
+	index := make(map[string]byte, len(seedWordList))
+	for i, word := range seedWordList {
+		index[word] = byte(i)
+	}
+	return index
+}()
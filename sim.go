@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often the simulation checks whether any node's chain tip has changed
+const tipPollInterval = 200 * time.Millisecond
+
+var simMsgTypes = map[string]MsgType{
+	"PeerListRequest":      PeerListRequest,
+	"PeerListResponse":     PeerListResponse,
+	"PeerBroadcast":        PeerBroadcast,
+	"BlockChainRequest":    BlockChainRequest,
+	"BlockChainResponse":   BlockChainResponse,
+	"BlockBroadcast":       BlockBroadcast,
+	"BlockRequest":         BlockRequest,
+	"BlockResponse":        BlockResponse,
+	"TransactionRequest":   TransactionRequest,
+	"TransactionResponse":  TransactionResponse,
+	"TransactionBroadcast": TransactionBroadcast,
+	"Ping":                 Ping,
+	"Pong":                 Pong,
+}
+
+type simNode struct {
+	name    string
+	book    *AddrBook // survives restarts, as if it were kept in a file
+	state   *State
+	network *PeerNetwork // nil while the node is dead
+}
+
+// Simulation runs many peers in one process over a MemNetwork, following a
+// script of faults to inject, and prints a timeline of each node's chain tip
+type Simulation struct {
+	mn       *MemNetwork
+	seed     int64
+	rand     *rand.Rand
+	nodes    []*simNode
+	byName   map[string]*simNode
+	start    time.Time
+	lastTips string
+	lock     sync.Mutex
+}
+
+// runs the simulation script at path. Each line of the script is one of the
+// following commands, run in order (blank lines and # comments are ignored):
+//
+//	seed N                 seed the random choices (must come before nodes)
+//	nodes N                start N more nodes, each joining via the previous one
+//	latency MS [JITTER]    every message takes MS (plus up to JITTER) milliseconds
+//	loss PERCENT           drop the given percentage of messages
+//	delay TYPE MS          delay messages of TYPE (eg BlockBroadcast) by MS more
+//	partition A B | C D    split the nodes into groups that can't reach each other
+//	heal                   remove the partition
+//	mine NODE [COUNT]      have NODE mine COUNT (default 1) blocks, one at a time
+//	kill NODE              shut NODE down
+//	restart NODE           start NODE again, with a fresh state but the same peers
+//	wait SECONDS           let the network run for a while
+//	tips                   print every node's chain tip now
+func RunSimulation(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	sim := &Simulation{seed: 1, byName: make(map[string]*simNode), start: time.Now()}
+
+	stop := make(chan bool)
+	go sim.watchTips(stop)
+	defer func() {
+		stop <- true
+		sim.printTips(true)
+		for _, node := range sim.nodes {
+			if node.network != nil {
+				node.network.Close()
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = strings.TrimSpace(text[:i])
+		}
+		if text == "" {
+			continue
+		}
+
+		sim.printf("> %s\n", text)
+		err := sim.run(strings.Fields(text))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (sim *Simulation) run(args []string) error {
+	cmd, args := args[0], args[1:]
+
+	if sim.mn == nil && cmd != "seed" {
+		sim.mn = NewMemNetwork(sim.seed)
+		sim.rand = rand.New(rand.NewSource(sim.seed))
+	}
+
+	switch cmd {
+	case "seed":
+		if sim.mn != nil {
+			return errors.New("seed must come before anything else")
+		}
+		return simArgs(args, 1, 1, &sim.seed)
+	case "nodes":
+		var count int64
+		if err := simArgs(args, 1, 1, &count); err != nil {
+			return err
+		}
+		for i := int64(0); i < count; i++ {
+			if err := sim.addNode(); err != nil {
+				return err
+			}
+		}
+	case "latency":
+		var latency, jitter int64
+		if err := simArgs(args, 1, 2, &latency, &jitter); err != nil {
+			return err
+		}
+		sim.mn.SetLatency(time.Duration(latency)*time.Millisecond, time.Duration(jitter)*time.Millisecond)
+	case "loss":
+		var percent int64
+		if err := simArgs(args, 1, 1, &percent); err != nil {
+			return err
+		}
+		sim.mn.SetLoss(float64(percent) / 100)
+	case "delay":
+		if len(args) != 2 {
+			return errors.New("usage: delay TYPE MS")
+		}
+		msgType, ok := simMsgTypes[args[0]]
+		if !ok {
+			return fmt.Errorf("unknown message type %q", args[0])
+		}
+		var delay int64
+		if err := simArgs(args[1:], 1, 1, &delay); err != nil {
+			return err
+		}
+		sim.mn.SetTypeDelay(msgType, time.Duration(delay)*time.Millisecond)
+	case "partition":
+		var groups [][]string
+		for _, group := range strings.Split(strings.Join(args, " "), "|") {
+			names := strings.Fields(group)
+			for _, name := range names {
+				if sim.byName[name] == nil {
+					return fmt.Errorf("unknown node %q", name)
+				}
+			}
+			groups = append(groups, names)
+		}
+		sim.mn.Partition(groups...)
+	case "heal":
+		sim.mn.Heal()
+	case "mine":
+		var count int64 = 1
+		if len(args) < 1 {
+			return errors.New("usage: mine NODE [COUNT]")
+		}
+		if err := simArgs(args[1:], 0, 1, &count); err != nil {
+			return err
+		}
+		node, err := sim.liveNode(args[0])
+		if err != nil {
+			return err
+		}
+		for i := int64(0); i < count; i++ {
+			mineBlock(node.state, node.network, sim.rand, nil)
+			sim.printTips(false)
+		}
+	case "kill":
+		if len(args) != 1 {
+			return errors.New("usage: kill NODE")
+		}
+		node, err := sim.liveNode(args[0])
+		if err != nil {
+			return err
+		}
+		sim.lock.Lock()
+		node.network.Close()
+		node.network = nil
+		sim.lock.Unlock()
+	case "restart":
+		if len(args) != 1 {
+			return errors.New("usage: restart NODE")
+		}
+		node := sim.byName[args[0]]
+		if node == nil {
+			return fmt.Errorf("unknown node %q", args[0])
+		}
+		if node.network != nil {
+			return fmt.Errorf("node %q is already running", args[0])
+		}
+		return sim.startNode(node, node.book.Candidates())
+	case "wait":
+		if len(args) != 1 {
+			return errors.New("usage: wait SECONDS")
+		}
+		seconds, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return err
+		}
+		time.Sleep(time.Duration(seconds * float64(time.Second)))
+	case "tips":
+		sim.printTips(true)
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+
+	return nil
+}
+
+// parses between min and max integer arguments into vals
+func simArgs(args []string, min, max int, vals ...*int64) error {
+	if len(args) < min || len(args) > max {
+		return errors.New("wrong number of arguments")
+	}
+	for i, arg := range args {
+		val, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return err
+		}
+		*vals[i] = val
+	}
+	return nil
+}
+
+func (sim *Simulation) liveNode(name string) (*simNode, error) {
+	node := sim.byName[name]
+	if node == nil {
+		return nil, fmt.Errorf("unknown node %q", name)
+	}
+	if node.network == nil {
+		return nil, fmt.Errorf("node %q is not running", name)
+	}
+	return node, nil
+}
+
+func (sim *Simulation) addNode() error {
+	book, _ := LoadAddrBook("")
+	node := &simNode{name: "n" + strconv.Itoa(len(sim.nodes)), book: book}
+
+	var seeds []string
+	if len(sim.nodes) > 0 {
+		seeds = []string{sim.nodes[len(sim.nodes)-1].name}
+	}
+
+	err := sim.startNode(node, seeds)
+	if err != nil {
+		return err
+	}
+
+	sim.lock.Lock()
+	sim.nodes = append(sim.nodes, node)
+	sim.byName[node.name] = node
+	sim.lock.Unlock()
+	return nil
+}
+
+func (sim *Simulation) startNode(node *simNode, seeds []string) error {
+	state := NewState()
+	config := PeerNetworkConfig{
+		Address:   node.name,
+		Seeds:     seeds,
+		Book:      node.book,
+		Transport: sim.mn.Transport(node.name),
+		State:     state,
+	}
+
+	network, err := NewPeerNetwork(config)
+	if err != nil && len(seeds) > 0 {
+		// none of the peers it knew about are reachable right now; it will
+		// keep trying to reconnect to them in the background
+		config.Seeds = nil
+		network, err = NewPeerNetwork(config)
+	}
+	if err != nil {
+		return err
+	}
+	network.RequestBlockChain("", nil)
+
+	sim.lock.Lock()
+	node.state = state
+	node.network = network
+	sim.lock.Unlock()
+	return nil
+}
+
+func (sim *Simulation) watchTips(stop chan bool) {
+	ticker := time.NewTicker(tipPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			sim.printTips(false)
+		}
+	}
+}
+
+// prints the nodes grouped by their chain tip, if the grouping has changed
+// since it was last printed (or always, if force is set)
+func (sim *Simulation) printTips(force bool) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+
+	type tip struct {
+		hash   string
+		height int
+		nodes  []string
+	}
+	tips := make(map[string]*tip)
+	var down []string
+
+	for _, node := range sim.nodes {
+		if node.network == nil {
+			down = append(down, node.name)
+			continue
+		}
+
+		t := &tip{hash: "genesis"}
+		if block := node.state.Tip(); block != nil {
+			t.hash = fmt.Sprintf("%x", block.Hash()[:3])
+			t.height = node.state.Height()
+		}
+		if tips[t.hash] == nil {
+			tips[t.hash] = t
+		}
+		tips[t.hash].nodes = append(tips[t.hash].nodes, node.name)
+	}
+
+	sorted := make([]*tip, 0, len(tips))
+	for _, t := range tips {
+		sorted = append(sorted, t)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].height != sorted[j].height {
+			return sorted[i].height > sorted[j].height
+		}
+		return sorted[i].hash < sorted[j].hash
+	})
+
+	var groups []string
+	for _, t := range sorted {
+		groups = append(groups, fmt.Sprintf("%s (%d blocks): %s", t.hash, t.height, strings.Join(t.nodes, " ")))
+	}
+	if len(down) > 0 {
+		groups = append(groups, "down: "+strings.Join(down, " "))
+	}
+	summary := strings.Join(groups, " | ")
+
+	if force || summary != sim.lastTips {
+		sim.lastTips = summary
+		sim.printfLocked("%d tips: %s\n", len(sorted), summary)
+	}
+}
+
+func (sim *Simulation) printf(format string, args ...interface{}) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+
+	sim.printfLocked(format, args...)
+}
+
+func (sim *Simulation) printfLocked(format string, args ...interface{}) {
+	fmt.Printf("[%7.1fs] ", time.Since(sim.start).Seconds())
+	fmt.Printf(format, args...)
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"bytes"
-	"crypto/rsa"
+	"errors"
+	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
 type State struct {
@@ -12,19 +15,53 @@ type State struct {
 	// main state
 	primary    *BlockChain
 	alternates []*BlockChain
-	wallet     map[string]*rsa.PrivateKey
+	wallet     map[Address]*PrivateKey
 	keys       KeySet
+	index      *AddressIndex
 
-	pendingTxns []*Transaction
-	beingMined  int
-	ResetMiner  bool
+	// addresses we follow without being able to spend from them, with their
+	// public keys if we know them
+	watched map[Address]*PublicKey
+
+	// if the wallet is deterministic, where each of our keys comes from, and
+	// how far along each branch we've used and derived keys
+	seed        *Seed
+	seedPaths   map[Address]seedPath
+	seedNext    [numBranches]uint32
+	seedDerived [numBranches]uint32
+
+	// transactions waiting to be mined, and transactions and blocks
+	// waiting for their parents to arrive
+	mempool      *Mempool
+	orphans      *OrphanPool
+	orphanBlocks *OrphanBlockPool
+
+	conflicts  []*Conflict
+	tracked    []*TrackedTxn
+	beingMined *Block
+	ResetMiner bool
+
+	// called (with the lock held) with anything the wallet owner should know
+	// about straight away, such as a payment to them being double-spent
+	Notify func(msg string)
+}
+
+type seedPath struct {
+	branch int
+	index  uint32
 }
 
 func NewState() *State {
 	s := &State{}
 	s.primary = &BlockChain{}
-	s.wallet = make(map[string]*rsa.PrivateKey)
+	s.wallet = make(map[Address]*PrivateKey)
+	s.seedPaths = make(map[Address]seedPath)
 	s.keys = make(KeySet)
+	s.index = NewAddressIndex()
+	s.watched = make(map[Address]*PublicKey)
+	s.mempool = NewMempool()
+	s.orphans = NewOrphanPool()
+	s.orphanBlocks = NewOrphanBlockPool()
 
 	return s
 }
@@ -33,18 +70,29 @@ func NewState() *State {
 // public, locked functions
 //
 
-func (s *State) GenTxnInput(key rsa.PublicKey) TxnInput {
+// returns an (unsigned) input spending the coins at one of our addresses, or at
+// a watched address whose public key we know
+func (s *State) GenTxnInput(addr Address) TxnInput {
 	s.RLock()
 	defer s.RUnlock()
 
-	prev := s.keys[key.N.String()]
+	var key *PublicKey
+	if s.wallet[addr] != nil {
+		key = &s.wallet[addr].PublicKey
+	} else if s.watched[addr] != nil {
+		key = s.watched[addr]
+	} else {
+		panic("address not in wallet")
+	}
+
+	prev := s.keys[addr]
 	if prev == nil {
-		prev = s.primary.Keys[key.N.String()]
+		prev = s.primary.Keys[addr]
 	}
 	if prev == nil {
 		panic("invalid key")
 	}
-	input := TxnInput{key, prev.Hash(), nil}
+	input := TxnInput{*key, prev.Hash(), nil}
 
 	return input
 }
@@ -56,108 +104,472 @@ func (s *State) Sign(txn *Transaction) error {
 	return txn.Sign(s.wallet)
 }
 
+// signs the inputs of txn that spend from our wallet, returning how many
+func (s *State) SignAvailable(txn *Transaction) (int, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return txn.SignAvailable(s.wallet)
+}
+
+// adds txn to the mempool if it is valid and new, returning true if so
 func (s *State) AddTxn(txn *Transaction) bool {
 	s.Lock()
 	defer s.Unlock()
 
-	success := s.keys.AddTxn(txn)
+	added := s.addTxn(txn)
+	if len(added) > 0 {
+		s.updateTracked()
+	}
+	return len(added) > 0
+}
+
+// like AddTxn, but returns txn along with any orphans that it allowed into the
+// mempool (all of which are new, so should be relayed), or nil if txn wasn't added
+func (s *State) AcceptTxn(txn *Transaction) []*Transaction {
+	s.Lock()
+	defer s.Unlock()
 
-	if success {
-		s.pendingTxns = append(s.pendingTxns, txn)
+	added := s.addTxn(txn)
+	if len(added) > 0 {
+		s.updateTracked()
 	}
+	return added
+}
+
+// returns the transactions waiting to be mined
+func (s *State) MempoolEntries() []*MempoolEntry {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.mempool.Entries()
+}
 
-	return success
+// returns the given pending txn and every pending txn spending from it, which
+// are all replaced along with it
+func (s *State) MempoolDescendants(entry *MempoolEntry) []*MempoolEntry {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.mempool.Descendants([]*MempoolEntry{entry})
+}
+
+// returns the transactions waiting for their parents
+func (s *State) OrphanEntries() []*OrphanEntry {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.orphans.Entries()
+}
+
+func (s *State) AddToWallet(key *PrivateKey) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.wallet[AddressOf(&key.PublicKey)] = key
+}
+
+// makes the wallet deterministic: from now on every new key is derived from the
+// seed. Any keys the seed has already used, as shown by payments to them in the
+// primary chain, are recovered into the wallet (and the chain is searched again
+// whenever it changes, so a wallet can be recovered before the chain arrives)
+func (s *State) SetSeed(seed *Seed) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.seed = seed
+	s.scanSeedKeys()
 }
 
-func (s *State) AddToWallet(key *rsa.PrivateKey) {
+// returns the wallet's seed, or nil if its keys are random
+func (s *State) Seed() *Seed {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.seed
+}
+
+// returns a new key from the given branch of the seed (or a random one if the
+// wallet isn't deterministic), already added to the wallet
+func (s *State) NewKey(branch int) *PrivateKey {
 	s.Lock()
 	defer s.Unlock()
 
-	s.wallet[key.PublicKey.N.String()] = key
+	if s.seed == nil {
+		key := genKey()
+		s.wallet[AddressOf(&key.PublicKey)] = key
+		return key
+	}
+
+	key := s.seed.Key(branch, s.seedNext[branch])
+	s.seedNext[branch]++
+	s.deriveSeedKeys()
+	return key
+}
+
+// returns the double-spends we've seen, oldest first
+func (s *State) Conflicts() []*Conflict {
+	s.RLock()
+	defer s.RUnlock()
+
+	return append([]*Conflict(nil), s.conflicts...)
+}
+
+// returns true if we have the private key for the address
+func (s *State) InWallet(addr Address) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.wallet[addr] != nil
+}
+
+// starts following the balance and history of an address that isn't ours. If
+// key is given, addr is ignored and the key's address is watched instead (which
+// also lets payments from it be created here, to be signed elsewhere)
+func (s *State) Watch(addr Address, key *PublicKey) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if key != nil {
+		addr = AddressOf(key)
+	}
+	if s.wallet[addr] != nil {
+		return errors.New("That address is already in your wallet")
+	}
+	if key != nil || s.watched[addr] == nil {
+		s.watched[addr] = key
+	}
+	return nil
+}
+
+// stops watching an address, returning false if it wasn't being watched
+func (s *State) Unwatch(addr Address) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	_, ok := s.watched[addr]
+	delete(s.watched, addr)
+	return ok
+}
+
+// returns the coins held at each watched address (including those with none)
+func (s *State) GetWatched() map[Address]uint64 {
+	s.RLock()
+	defer s.RUnlock()
+
+	ret := make(map[Address]uint64)
+	for addr := range s.watched {
+		ret[addr] = 0
+		if txn := s.keys[addr]; txn != nil {
+			_, ret[addr] = txn.OutputAmount(addr)
+		}
+	}
+	return ret
+}
+
+// returns the coins at the watched addresses whose public keys we know, which
+// can be spent by a txn signed elsewhere
+func (s *State) WatchedCoins() []Coin {
+	s.RLock()
+	defer s.RUnlock()
+
+	var coins []Coin
+	for addr, key := range s.watched {
+		if txn := s.keys[addr]; key != nil && txn != nil {
+			_, amount := txn.OutputAmount(addr)
+			coins = append(coins, Coin{addr, amount})
+		}
+	}
+	return coins
+}
+
+// returns true if the address currently holds coins (including from pending transactions)
+func (s *State) AddressFunded(addr Address) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.keys[addr] != nil
+}
+
+// returns the transaction that paid the coins held at addr, or nil if it holds none
+func (s *State) FundingTxn(addr Address) *Transaction {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.keys[addr]
+}
+
+// returns true if the address holds coins, or has ever been paid or spent from
+// in the primary chain
+func (s *State) AddressUsed(addr Address) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.keys[addr] != nil || len(s.index.Refs(addr)) > 0
 }
 
-func (s *State) GetWallet() map[rsa.PublicKey]uint64 {
+// returns the coins held at each of our addresses that has any
+func (s *State) GetWallet() map[Address]uint64 {
 	s.RLock()
 	defer s.RUnlock()
 
-	ret := make(map[rsa.PublicKey]uint64)
+	ret := make(map[Address]uint64)
 
-	for _, key := range s.wallet {
-		txn := s.keys[key.N.String()]
+	for addr := range s.wallet {
+		txn := s.keys[addr]
 
 		if txn != nil {
-			_, ret[key.PublicKey] = txn.OutputAmount(key.PublicKey)
+			_, ret[addr] = txn.OutputAmount(addr)
 		}
 	}
 
 	return ret
 }
 
-func (s *State) ConstructBlock() (*Block, *rsa.PrivateKey) {
+// returns our funded addresses as coins to spend from, in no particular order
+func (s *State) WalletCoins() []Coin {
+	var coins []Coin
+	for addr, amount := range s.GetWallet() {
+		if amount > 0 {
+			coins = append(coins, Coin{addr, amount})
+		}
+	}
+	return coins
+}
+
+// returns a channel that gets the transaction with the given hash once it has
+// the given number of confirmations, or once it fails (is conflicted or dropped),
+// or nil if the transaction isn't one we're tracking. The caller must call the
+// returned func when it stops waiting, so that the transaction can be untracked
+func (s *State) WaitForTxn(hash []byte, confirmations int) (<-chan TrackedTxn, func()) {
 	s.Lock()
 	defer s.Unlock()
 
-	txn, key := NewMinersTransation()
+	tracked := s.findTracked(hash)
+	if tracked == nil {
+		return nil, func() {}
+	}
+	done := make(chan TrackedTxn, 1)
+	tracked.waiters = append(tracked.waiters, txnWaiter{confirmations, done})
+	tracked.wake()
 
-	b := &Block{}
-	b.Txns = append(b.Txns, txn)
-	b.Txns = append(b.Txns, s.pendingTxns...)
+	cancel := func() {
+		s.Lock()
+		defer s.Unlock()
+
+		if tracked := s.findTracked(hash); tracked != nil {
+			tracked.unwait(done)
+		}
+	}
+	return done, cancel
+}
+
+// returns the transactions that pay or spend from our wallet (or if watchOnly,
+// from the addresses we're watching): those in the primary chain in the order
+// they were mined, followed by any pending ones
+func (s *State) History(watchOnly bool) []*HistoryEntry {
+	s.RLock()
+	defer s.RUnlock()
+
+	owned := s.inWallet
+	var addrs []Address
+	if watchOnly {
+		owned = s.isWatched
+		for addr := range s.watched {
+			addrs = append(addrs, addr)
+		}
+	} else {
+		for addr := range s.wallet {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	var refs []txnRef
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		for _, ref := range s.index.Refs(addr) {
+			if !seen[string(ref.Hash)] {
+				seen[string(ref.Hash)] = true
+				refs = append(refs, ref)
+			}
+		}
+	}
+
+	// blocks don't say when they were mined, so their order in the chain is the
+	// best we can do
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Height != refs[j].Height {
+			return refs[i].Height < refs[j].Height
+		}
+		return refs[i].Pos < refs[j].Pos
+	})
+
+	var history []*HistoryEntry
+	for _, ref := range refs {
+		entry := s.historyEntry(ref.Txn, ref.Hash, ref.Height, owned)
+		entry.Status = TxnConfirmed
+		entry.Confirmations = len(s.primary.Blocks) - ref.Height
+		history = append(history, entry)
+	}
+
+	for _, entry := range s.mempool.Entries() {
+		if touches(entry.Txn, owned) {
+			history = append(history, s.historyEntry(entry.Txn, entry.Hash, -1, owned))
+		}
+	}
 
+	for _, tracked := range s.tracked {
+		if tracked.Failed() && !watchOnly {
+			entry := s.historyEntry(tracked.Txn, tracked.Hash, -1, owned)
+			entry.Status = tracked.Status
+			history = append(history, entry)
+		}
+	}
+
+	return history
+}
+
+// returns a block to mine (with no nonce yet) and the key its reward is paid to
+func (s *State) ConstructBlock() (*Block, *PrivateKey) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.pruneMempool()
+
+	b := &Block{}
 	if s.primary.Last() != nil {
 		b.PrevHash = s.primary.Last().Hash()
 	}
+
+	template := NewBlockTemplate(s.mempool, b.PrevHash)
+	// a deterministic wallet pays the reward for each height to the same key, so
+	// that rewards can be found again just by going through the chain
+	var key *PrivateKey
+	if s.seed != nil {
+		key = s.seed.Key(branchMining, uint32(len(s.primary.Blocks)))
+	} else {
+		key = genKey()
+	}
+	txn := NewMinersTransation(AddressOf(&key.PublicKey), template.Fees)
+	b.Txns = append(b.Txns, txn)
+	b.Txns = append(b.Txns, template.Txns()...)
+
 	s.ResetMiner = false
-	s.beingMined = len(s.pendingTxns) + 1
+	s.beingMined = b
 
 	return b, key
 }
 
+// returns the pending transactions that would be mined if we started on a new
+// block now
+func (s *State) BlockTemplate() *BlockTemplate {
+	s.RLock()
+	defer s.RUnlock()
+
+	var prevHash []byte
+	if s.primary.Last() != nil {
+		prevHash = s.primary.Last().Hash()
+	}
+	return NewBlockTemplate(s.mempool, prevHash)
+}
+
+// returns the last block of the primary chain
+func (s *State) Tip() *Block {
+	s.RLock()
+	defer s.RUnlock()
+	return s.primary.Last()
+}
+
+// returns the number of blocks in the primary chain
+func (s *State) Height() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.primary.Blocks)
+}
+
 func (s *State) ChainFromHash(hash []byte) *BlockChain {
 	s.RLock()
 	defer s.RUnlock()
 	return s.chainFromHash(hash)
 }
 
-func (s *State) AddBlockChain(chain *BlockChain) {
+// returns true if the chain replaced our primary chain
+func (s *State) AddBlockChain(chain *BlockChain) bool {
 	s.Lock()
 	defer s.Unlock()
 
 	if len(s.primary.Blocks) < len(chain.Blocks) {
+		// the peer that sent the chain also sent its keys, but we can't just
+		// trust those, so we work them out for ourselves, checking every block
+		if !chain.Verify() {
+			logger.Println("Received invalid blockchain")
+			return false
+		}
+		checked := chain.Fork(len(chain.Blocks))
+		if checked == nil {
+			logger.Println("Received blockchain with invalid txns")
+			return false
+		}
+		chain = checked
+
 		logger.Println("Replaced primary blockchain")
 		s.alternates = append(s.alternates, s.primary)
 		s.primary = chain
 		s.reset()
+		s.retryOrphanBlocks()
+		return true
 	}
+
+	return false
 }
 
-// first return is if the block was accepted, second
-// is if we already have the relevant chain
-func (s *State) AddBlock(b *Block) (bool, bool) {
+// returns true if the block is already part of one of our chains
+func (s *State) HasBlock(hash []byte) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.findBlock(hash) != nil
+}
+
+// returns the block with the given hash from any of our chains, or nil
+func (s *State) Block(hash []byte) *Block {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.findBlock(hash)
+}
+
+// returns the blocks that were added to one of our chains: b, followed by any
+// orphans that were waiting for it. If b is an orphan (its parent isn't in any
+// of our chains) it is kept until its ancestors arrive, and we return the hash
+// of the ancestor that is missing and how many orphans are waiting on it
+func (s *State) AddBlock(b *Block) ([]*Block, []byte, int) {
 	if !b.Verify() {
-		return false, false
+		return nil, nil, 0
 	}
 
 	s.Lock()
 	defer s.Unlock()
 
-	chain := s.chainFromHash(b.PrevHash)
+	hash := b.Hash()
+	if s.findBlock(hash) != nil || s.orphanBlocks.Get(hash) != nil {
+		return nil, nil, 0
+	}
+	s.orphanBlocks.Expire()
 
+	chain := s.chainForParent(b.PrevHash)
 	if chain == nil {
-		logger.Println("Received block for unknown chain")
-		return true, false
+		s.orphanBlocks.Add(b)
+		missing, depth := s.orphanBlocks.Missing(hash)
+		logger.Printf("Received orphan block %x (%d waiting on its missing ancestor)", hash[:6], depth)
+		return nil, missing, depth
 	}
 
-	success := chain.Append(b)
-	if !success {
-		logger.Println("Failed to append to chain")
-		return false, true
+	if !s.appendBlock(chain, b) {
+		return nil, nil, 0
 	}
 
-	if chain == s.primary {
-		s.reset()
-	}
-
-	return true, true
+	return append([]*Block{b}, s.connectOrphanBlocks(hash)...), nil, 0
 }
 
 //
@@ -166,15 +578,12 @@ func (s *State) AddBlock(b *Block) (bool, bool) {
 
 func (s *State) reset() {
 	s.ResetMiner = true
-	s.keys = s.primary.Keys.Copy()
-
-	var tmp []*Transaction
-	for _, txn := range s.pendingTxns {
-		if s.keys.AddTxn(txn) {
-			tmp = append(tmp, txn)
-		}
-	}
-	s.pendingTxns = tmp
+	s.index.Update(s.primary)
+	s.rebuildKeys()
+	s.pruneMempool()
+	s.retryOrphans()
+	s.scanSeedKeys()
+	s.updateTracked()
 
 	var alts []*BlockChain
 	for _, chain := range s.alternates {
@@ -187,12 +596,568 @@ func (s *State) reset() {
 	s.alternates = alts
 }
 
+func (s *State) inWallet(addr Address) bool {
+	return s.wallet[addr] != nil
+}
+
+func (s *State) isWatched(addr Address) bool {
+	_, ok := s.watched[addr]
+	return ok
+}
+
+// returns true if txn pays or spends from any of the owned addresses
+func touches(txn *Transaction, owned func(Address) bool) bool {
+	for _, addr := range txnAddresses(txn) {
+		if owned(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *State) findTracked(hash []byte) *TrackedTxn {
+	for _, tracked := range s.tracked {
+		if bytes.Equal(tracked.Hash, hash) {
+			return tracked
+		}
+	}
+	return nil
+}
+
+// starts tracking any new transactions involving our wallet (other than mining
+// rewards) in the mempool or the last few blocks, and brings the status of every
+// tracked transaction up to date, letting the wallet owner know of any changes
+func (s *State) updateTracked() {
+	// anything deeper would be settled straight away
+	start := len(s.primary.Blocks) - trackDepth + 1
+	if start < 0 {
+		start = 0
+	}
+	var candidates []*Transaction
+	for _, b := range s.primary.Blocks[start:] {
+		candidates = append(candidates, b.Txns...)
+	}
+	for _, entry := range s.mempool.Entries() {
+		candidates = append(candidates, entry.Txn)
+	}
+
+	for _, txn := range candidates {
+		if txn.IsMiner() || !touches(txn, s.inWallet) {
+			continue
+		}
+		hash := txn.Hash()
+		if s.findTracked(hash) != nil {
+			continue
+		}
+
+		entry := s.historyEntry(txn, hash, -1, s.inWallet)
+		tracked := &TrackedTxn{Txn: txn, Hash: hash, Net: entry.Net(), Status: TxnPending, Changed: time.Now()}
+		s.tracked = append(s.tracked, tracked)
+		s.setTrackedStatus(tracked)
+		if entry.Sent == 0 && s.Notify != nil {
+			s.Notify(fmt.Sprintf("Incoming payment of %d coins in txn %x (%s)",
+				entry.Received, hash[:6], tracked.describe()))
+		}
+	}
+
+	var keep, failed []*TrackedTxn
+	for _, tracked := range s.tracked {
+		was := tracked.Status
+		s.setTrackedStatus(tracked)
+		if tracked.Status != was {
+			tracked.Changed = time.Now()
+			s.notifyTracked(tracked, was)
+		}
+		tracked.wake()
+
+		if tracked.Failed() {
+			failed = append(failed, tracked)
+		}
+		if !tracked.settled() {
+			keep = append(keep, tracked)
+		}
+	}
+
+	// forget the oldest failures once there are too many
+	for i := 0; i < len(failed)-maxTrackedFailed; i++ {
+		for j := range keep {
+			if keep[j] == failed[i] {
+				keep = append(keep[:j], keep[j+1:]...)
+				break
+			}
+		}
+	}
+	s.tracked = keep
+}
+
+// works out where a tracked transaction has got to
+func (s *State) setTrackedStatus(tracked *TrackedTxn) {
+	tracked.Conflict = nil
+	tracked.Confirmations = 0
+
+	if ref, ok := s.index.Find(tracked.Hash); ok {
+		tracked.Status = TxnConfirmed
+		tracked.Confirmations = len(s.primary.Blocks) - ref.Height
+		return
+	}
+	if s.mempool.Get(tracked.Hash) != nil {
+		tracked.Status = TxnPending
+		return
+	}
+	for _, conflict := range s.conflicts {
+		if conflict.Dropped == tracked.Txn || bytes.Equal(conflict.Dropped.Hash(), tracked.Hash) {
+			tracked.Status = TxnConflicted
+			tracked.Conflict = conflict
+			return
+		}
+	}
+	tracked.Status = TxnDropped
+}
+
+func (s *State) notifyTracked(tracked *TrackedTxn, was TxnStatus) {
+	if s.Notify == nil {
+		return
+	}
+
+	txn := fmt.Sprintf("Txn %x (%+d coins)", tracked.Hash[:6], tracked.Net)
+	switch {
+	case tracked.Status == TxnConfirmed:
+		s.Notify(fmt.Sprintf("%s was mined", txn))
+	case tracked.Status == TxnPending && was == TxnConfirmed:
+		s.Notify(fmt.Sprintf("%s is no longer in the primary chain, and is pending again", txn))
+	case tracked.Status == TxnConflicted:
+		// recordConflict has already said if coins paid to us were lost, and
+		// there's no need to say when we replaced a txn ourselves
+		if tracked.Conflict.Lost == 0 && !s.spendsFromWallet(tracked.Conflict.Kept) {
+			s.Notify(fmt.Sprintf("%s can never be mined, txn %x spends the same coins",
+				txn, tracked.Conflict.Kept.Hash()[:6]))
+		}
+	case tracked.Status == TxnDropped:
+		s.Notify(fmt.Sprintf("%s was dropped, and won't be mined unless it's sent again", txn))
+	}
+}
+
+// returns true if any of txn's inputs are from our addresses
+func (s *State) spendsFromWallet(txn *Transaction) bool {
+	for _, input := range txn.Inputs {
+		if s.wallet[AddressOf(&input.Key)] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// works out what txn means for the owned addresses
+func (s *State) historyEntry(txn *Transaction, hash []byte, height int, owned func(Address) bool) *HistoryEntry {
+	entry := &HistoryEntry{Txn: txn, Hash: hash, Height: height}
+
+	var theirs []Address
+	for _, input := range txn.Inputs {
+		addr := AddressOf(&input.Key)
+		if owned(addr) {
+			entry.Sent += s.spentAmount(addr, input.PrevHash)
+		} else {
+			theirs = append(theirs, addr)
+		}
+	}
+
+	for _, output := range txn.Outputs {
+		if owned(output.Address) {
+			entry.Received += output.Amount
+		} else if entry.Sent > 0 {
+			entry.Counterparties = append(entry.Counterparties, output.Address)
+		}
+	}
+	if entry.Sent == 0 {
+		entry.Counterparties = theirs
+	}
+
+	return entry
+}
+
+// returns the coins that the transaction with the given hash paid to addr
+func (s *State) spentAmount(addr Address, prevHash []byte) uint64 {
+	if entry := s.mempool.Get(prevHash); entry != nil {
+		_, amount := entry.Txn.OutputAmount(addr)
+		return amount
+	}
+	for _, ref := range s.index.Refs(addr) {
+		if bytes.Equal(ref.Hash, prevHash) {
+			_, amount := ref.Txn.OutputAmount(addr)
+			return amount
+		}
+	}
+	return 0
+}
+
+// adds the keys that the seed could have used to the wallet: every mining key up
+// to the height of the primary chain, and seedGapLimit keys beyond the last one
+// used on each of the other branches
+func (s *State) deriveSeedKeys() {
+	for branch := range s.seedDerived {
+		want := s.seedNext[branch] + seedGapLimit
+		if branch == branchMining {
+			want = uint32(len(s.primary.Blocks)) + 1
+		}
+
+		for ; s.seedDerived[branch] < want; s.seedDerived[branch]++ {
+			key := s.seed.Key(branch, s.seedDerived[branch])
+			addr := AddressOf(&key.PublicKey)
+			s.wallet[addr] = key
+			s.seedPaths[addr] = seedPath{branch, s.seedDerived[branch]}
+		}
+	}
+}
+
+// looks in the primary chain for payments to keys from the seed, moving past any
+// that have been used. Deriving more keys can turn up more payments, so this goes
+// on until there are no more
+func (s *State) scanSeedKeys() {
+	if s.seed == nil {
+		return
+	}
+
+	for {
+		s.deriveSeedKeys()
+
+		found := false
+		for addr, path := range s.seedPaths {
+			if path.index >= s.seedNext[path.branch] && len(s.index.Refs(addr)) > 0 {
+				s.seedNext[path.branch] = path.index + 1
+				found = true
+			}
+		}
+		if !found {
+			return
+		}
+	}
+}
+
+// adds txn to the mempool if it is valid and new, returning it along with any
+// orphans that were waiting on it (and were valid), or nil if it wasn't added. If
+// txn is only invalid because we haven't seen its parents yet, it is kept as an
+// orphan until they arrive
+func (s *State) addTxn(txn *Transaction) []*Transaction {
+	if len(txn.Inputs) == 0 {
+		return nil // only miners get to create coins, and only in blocks
+	}
+
+	hash := txn.Hash()
+	if s.mempool.Get(hash) != nil || s.orphans.Get(hash) != nil {
+		return nil
+	}
+
+	// a txn spending the same keys as pending ones may replace them (and
+	// anything spending from them) if it pays a higher fee than all of them
+	keys := s.keys
+	conflicts := s.mempool.Conflicts(txn)
+	var replacing []*MempoolEntry
+	if len(conflicts) > 0 {
+		replacing = s.mempool.Descendants(conflicts)
+		keys = s.keysWithout(replacing)
+	}
+
+	fee, ok := keys.Fee(txn)
+	if !ok {
+		missing := s.missingParents(txn)
+		if len(replacing) == 0 && len(missing) > 0 && txn.VerifySignatures() {
+			logger.Printf("Txn %x is an orphan, waiting for %d parents", hash[:6], len(missing))
+			s.orphans.Add(txn, missing)
+		}
+		return nil
+	}
+
+	var replacedFees uint64
+	for _, entry := range replacing {
+		replacedFees += entry.Fee
+	}
+	if len(replacing) > 0 && fee <= replacedFees {
+		if txn.VerifySignatures() {
+			for _, entry := range conflicts {
+				s.recordConflict(ConflictRejected, entry.Txn, txn, []*Transaction{txn})
+			}
+		}
+		return nil
+	}
+
+	if !keys.AddTxn(txn) {
+		return nil
+	}
+	for _, entry := range conflicts {
+		var lost []*Transaction
+		for _, removed := range s.mempool.Remove(entry.Hash) {
+			lost = append(lost, removed.Txn)
+		}
+		s.recordConflict(ConflictReplaced, txn, entry.Txn, lost)
+	}
+	s.keys = keys
+	s.mempool.Add(txn, fee)
+
+	s.pruneMempool()
+	if s.mempool.Get(hash) == nil {
+		return nil
+	}
+
+	added := []*Transaction{txn}
+	for _, child := range s.orphans.Children(hash) {
+		s.orphans.Remove(child.Hash)
+		added = append(added, s.addTxn(child.Txn)...)
+	}
+	return added
+}
+
+// returns the hashes of the transactions that txn spends from which we have never
+// seen. Note that a parent that has been mined and fully spent looks the same as
+// one we haven't seen yet, so stale transactions can end up as orphans too (where
+// they stay until they expire)
+func (s *State) missingParents(txn *Transaction) [][]byte {
+	var missing [][]byte
+	seen := make(map[string]bool)
+
+	for _, input := range txn.Inputs {
+		if s.keys[AddressOf(&input.Key)] != nil || s.mempool.Get(input.PrevHash) != nil {
+			continue
+		}
+		if !seen[string(input.PrevHash)] {
+			seen[string(input.PrevHash)] = true
+			missing = append(missing, input.PrevHash)
+		}
+	}
+
+	return missing
+}
+
+// tries again to add every orphan whose parents have all arrived (eg in a block)
+func (s *State) retryOrphans() {
+	for _, entry := range s.orphans.Entries() {
+		if s.orphans.Get(entry.Hash) == nil {
+			continue // already added as the child of another
+		}
+		if _, ok := s.keys.Fee(entry.Txn); ok {
+			s.orphans.Remove(entry.Hash)
+			s.addTxn(entry.Txn)
+		}
+	}
+}
+
+// recalculates keys from the primary chain and the mempool, dropping any pending
+// transactions that are no longer valid (eg because they have been mined)
+func (s *State) rebuildKeys() {
+	s.keys = s.primary.Keys.Copy()
+
+	for _, entry := range s.mempool.Entries() {
+		if s.mempool.Get(entry.Hash) == nil {
+			continue // already removed as the descendant of another
+		}
+		if s.keys.AddTxn(entry.Txn) {
+			continue
+		}
+
+		mined, winner := s.findMined(entry.Txn)
+		if mined {
+			s.mempool.RemoveMined(entry.Hash)
+			continue
+		}
+
+		var lost []*Transaction
+		for _, removed := range s.mempool.Remove(entry.Hash) {
+			lost = append(lost, removed.Txn)
+		}
+		if winner != nil {
+			s.recordConflict(ConflictMined, winner, entry.Txn, lost)
+		}
+	}
+}
+
+// searches the primary chain (most recent blocks first) for txn, returning true if
+// it has been mined, or else for a mined txn that spends any of the same keys
+func (s *State) findMined(txn *Transaction) (bool, *Transaction) {
+	hash := txn.Hash()
+
+	for i := len(s.primary.Blocks) - 1; i >= 0; i-- {
+		for _, other := range s.primary.Blocks[i].Txns {
+			if bytes.Equal(other.Hash(), hash) {
+				return true, nil
+			}
+			if len(conflictingAddresses(txn, other)) > 0 {
+				return false, other
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// records that kept and dropped spend the same keys, and that we won't be
+// accepting dropped (or lost, the txns spending from it, if any), letting the
+// wallet owner know if any of those were paying them
+func (s *State) recordConflict(kind ConflictKind, kept, dropped *Transaction, lost []*Transaction) {
+	for _, conflict := range s.conflicts {
+		if conflict.Kind == kind && bytes.Equal(conflict.Dropped.Hash(), dropped.Hash()) {
+			return // eg the same double-spend relayed to us by several peers
+		}
+	}
+
+	conflict := &Conflict{kind, kept, dropped, conflictingAddresses(kept, dropped), 0, time.Now()}
+	for _, txn := range lost {
+		for _, output := range txn.Outputs {
+			if s.wallet[output.Address] == nil {
+				continue
+			}
+			_, still := kept.OutputAmount(output.Address)
+			if output.Amount > still {
+				conflict.Lost += output.Amount - still
+			}
+		}
+	}
+
+	logger.Printf("Double-spend: txn %x %s in favour of %x", dropped.Hash()[:6], kind, kept.Hash()[:6])
+	s.conflicts = append(s.conflicts, conflict)
+	if len(s.conflicts) > maxConflicts {
+		s.conflicts = s.conflicts[1:]
+	}
+
+	if conflict.Lost > 0 && s.Notify != nil {
+		s.Notify(fmt.Sprintf("Payment of %d coins to you in txn %x was double-spent by txn %x (%s)",
+			conflict.Lost, dropped.Hash()[:6], kept.Hash()[:6], kind))
+	}
+}
+
+// returns the keys as they would be if the given pending transactions weren't
+func (s *State) keysWithout(entries []*MempoolEntry) KeySet {
+	without := make(map[*MempoolEntry]bool)
+	for _, entry := range entries {
+		without[entry] = true
+	}
+
+	keys := s.primary.Keys.Copy()
+	for _, entry := range s.mempool.Entries() {
+		if !without[entry] {
+			keys.AddTxn(entry.Txn)
+		}
+	}
+	return keys
+}
+
+// removes expired transactions (and orphans) and enforces the mempool size limit
+func (s *State) pruneMempool() {
+	s.orphans.Expire()
+
+	removed := s.mempool.Expire()
+	removed = append(removed, s.mempool.Evict()...)
+
+	if len(removed) > 0 {
+		s.rebuildKeys()
+		s.updateTracked()
+	}
+}
+
+// appends b to chain (which may be a new fork), switching our primary chain if
+// it ends up longer, and returns false if b isn't valid on chain
+func (s *State) appendBlock(chain *BlockChain, b *Block) bool {
+	if !chain.Append(b) {
+		logger.Println("Failed to append to chain")
+		return false
+	}
+
+	if chain == s.primary {
+		s.reset()
+		return true
+	}
+
+	known := false
+	for i := range s.alternates {
+		if s.alternates[i] == chain {
+			known = true
+			if len(chain.Blocks) > len(s.primary.Blocks) {
+				logger.Println("Switched primary blockchain to a longer alternate")
+				s.alternates[i] = s.primary
+				s.primary = chain
+				s.reset()
+			}
+			break
+		}
+	}
+	if !known {
+		if len(chain.Blocks) > len(s.primary.Blocks) {
+			logger.Println("Switched primary blockchain to a longer fork")
+			s.alternates = append(s.alternates, s.primary)
+			s.primary = chain
+			s.reset()
+		} else {
+			logger.Println("Started alternate blockchain")
+			s.alternates = append(s.alternates, chain)
+		}
+	}
+
+	return true
+}
+
+// adds any orphan blocks that were waiting on the block with the given hash
+// (and any waiting on those, and so on), returning the ones that were valid
+func (s *State) connectOrphanBlocks(hash []byte) []*Block {
+	var connected []*Block
+
+	for _, child := range s.orphanBlocks.Children(hash) {
+		s.orphanBlocks.Remove(child.Hash)
+		chain := s.chainForParent(child.Block.PrevHash)
+		if chain != nil && s.appendBlock(chain, child.Block) {
+			logger.Printf("Connected orphan block %x", child.Hash[:6])
+			connected = append(connected, child.Block)
+			connected = append(connected, s.connectOrphanBlocks(child.Hash)...)
+		}
+	}
+
+	return connected
+}
+
+// connects any orphan blocks whose parents have turned up (eg in a new chain)
+func (s *State) retryOrphanBlocks() {
+	for _, entry := range s.orphanBlocks.Entries() {
+		if s.orphanBlocks.Get(entry.Hash) != nil && s.findBlock(entry.Block.PrevHash) != nil {
+			s.connectOrphanBlocks(entry.Block.PrevHash)
+		}
+	}
+}
+
+func (s *State) findBlock(hash []byte) *Block {
+	for _, chain := range append([]*BlockChain{s.primary}, s.alternates...) {
+		if i := chain.Find(hash); i >= 0 {
+			return chain.Blocks[i]
+		}
+	}
+	return nil
+}
+
+// returns the chain that a block with the given parent should be appended to:
+// the chain ending in that parent, or if the parent is further back in one of
+// our chains a new fork from it. returns nil if we don't have the parent
+func (s *State) chainForParent(hash []byte) *BlockChain {
+	if hash == nil {
+		if len(s.primary.Blocks) == 0 {
+			return s.primary
+		}
+		return NewBlockChain() // a rival first block
+	}
+
+	if chain := s.chainFromHash(hash); chain != nil {
+		return chain
+	}
+
+	for _, chain := range append([]*BlockChain{s.primary}, s.alternates...) {
+		if i := chain.Find(hash); i >= 0 {
+			return chain.Fork(i + 1)
+		}
+	}
+	return nil
+}
+
 func (s *State) chainFromHash(hash []byte) *BlockChain {
 	if hash == nil {
 		return s.primary
 	}
 
-	if bytes.Equal(hash, s.primary.Last().Hash()) {
+	if s.primary.Last() != nil && bytes.Equal(hash, s.primary.Last().Hash()) {
 		return s.primary
 	}
 
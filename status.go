@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// how many blocks deep a transaction is buried before we stop tracking it
+	trackDepth = 6
+	// how many transactions that will never be mined we remember
+	maxTrackedFailed = 100
+)
+
+type TxnStatus int
+
+const (
+	// waiting in the mempool to be mined
+	TxnPending TxnStatus = iota
+	// in the primary chain
+	TxnConfirmed
+	// lost out to a double-spend, so can never be mined
+	TxnConflicted
+	// gone from the mempool (expired, evicted, or in a block that is no longer
+	// in the primary chain) without being mined
+	TxnDropped
+)
+
+func (status TxnStatus) String() string {
+	switch status {
+	case TxnPending:
+		return "pending"
+	case TxnConfirmed:
+		return "confirmed"
+	case TxnConflicted:
+		return "conflicted"
+	case TxnDropped:
+		return "dropped"
+	}
+	return "unknown"
+}
+
+// TrackedTxn follows a transaction paying or spending from our wallet until it
+// is safely mined or can never be
+type TrackedTxn struct {
+	Txn           *Transaction
+	Hash          []byte
+	Net           int64 // what it adds to (or takes from) our wallet
+	Status        TxnStatus
+	Confirmations int       // when Status is TxnConfirmed
+	Conflict      *Conflict // when Status is TxnConflicted
+	Changed       time.Time
+
+	waiters []txnWaiter
+}
+
+type txnWaiter struct {
+	confirmations int
+	done          chan TrackedTxn
+}
+
+// returns true if the transaction will never be mined as things stand (though
+// a dropped one might be if it is sent again)
+func (tracked *TrackedTxn) Failed() bool {
+	return tracked.Status == TxnConflicted || tracked.Status == TxnDropped
+}
+
+// tells every waiter that has got what it was waiting for: enough confirmations,
+// or to know that there won't be any
+func (tracked *TrackedTxn) wake() {
+	var waiting []txnWaiter
+	for _, waiter := range tracked.waiters {
+		if tracked.Failed() || (tracked.Status == TxnConfirmed && tracked.Confirmations >= waiter.confirmations) {
+			waiter.done <- *tracked
+		} else {
+			waiting = append(waiting, waiter)
+		}
+	}
+	tracked.waiters = waiting
+}
+
+// forgets the waiter with the given channel, if it is still waiting
+func (tracked *TrackedTxn) unwait(done chan TrackedTxn) {
+	var waiting []txnWaiter
+	for _, waiter := range tracked.waiters {
+		if waiter.done != done {
+			waiting = append(waiting, waiter)
+		}
+	}
+	tracked.waiters = waiting
+}
+
+// describes the status, with the number of confirmations if it has any
+func (tracked *TrackedTxn) describe() string {
+	if tracked.Status == TxnConfirmed {
+		return fmt.Sprintf("%d confirmations", tracked.Confirmations)
+	}
+	return tracked.Status.String()
+}
+
+// returns true if we can stop tracking the transaction
+func (tracked *TrackedTxn) settled() bool {
+	return tracked.Status == TxnConfirmed && tracked.Confirmations >= trackDepth && len(tracked.waiters) == 0
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWaitForTxnCancel(t *testing.T) {
+	s := NewState()
+	tracked := &TrackedTxn{Hash: []byte{1}, Status: TxnConfirmed, Confirmations: trackDepth}
+	s.tracked = append(s.tracked, tracked)
+
+	done, cancel := s.WaitForTxn(tracked.Hash, trackDepth+1)
+	select {
+	case <-done:
+		t.Fatal("woken before having enough confirmations")
+	default:
+	}
+	if tracked.settled() {
+		t.Error("settled while something is waiting for it")
+	}
+
+	cancel()
+	if len(tracked.waiters) != 0 {
+		t.Errorf("%d waiters left after cancelling", len(tracked.waiters))
+	}
+	if !tracked.settled() {
+		t.Error("not settled once nothing is waiting for it")
+	}
+
+	if done, cancel := s.WaitForTxn([]byte{2}, 1); done != nil {
+		t.Error("got a channel for a txn that isn't tracked")
+	} else {
+		cancel()
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+)
+
+// room left in a block template for the miner's transaction to grow, since the
+// amount it claims (and so its encoding) isn't known until the template is done
+const minerTxnSlack = 16
+
+// BlockTemplate is the set of pending transactions we would mine right now
+type BlockTemplate struct {
+	Entries   []*MempoolEntry // parents always before their children
+	Fees      uint64
+	Bytes     int // at most the size of the whole block, including the miner's txn
+	SigChecks int
+}
+
+func (t *BlockTemplate) Txns() []*Transaction {
+	txns := make([]*Transaction, len(t.Entries))
+	for i, entry := range t.Entries {
+		txns[i] = entry.Txn
+	}
+	return txns
+}
+
+// picks the pending transactions to mine on top of prevHash, within the block
+// limits. transactions paying the highest fee rate go first, but a transaction is
+// only picked once all of its pending parents have been. The result depends only
+// on the contents of the pool, so every peer with the same mempool builds the
+// same template
+func NewBlockTemplate(pool *Mempool, prevHash []byte) *BlockTemplate {
+	// gob leaves out zero values, so the miner txn is sized with a non-zero
+	// address standing in for the real one
+	var payTo Address
+	for i := range payTo {
+		payTo[i] = 0xff
+	}
+	miner := NewMinersTransation(payTo, 0)
+	base := &Block{PrevHash: prevHash, Txns: []*Transaction{miner}}
+
+	t := &BlockTemplate{Bytes: base.Size() + minerTxnSlack}
+
+	byRate := pool.Entries()
+	sort.Slice(byRate, func(i, j int) bool {
+		if byRate[i].FeeRate() != byRate[j].FeeRate() {
+			return byRate[i].FeeRate() > byRate[j].FeeRate()
+		}
+		return bytes.Compare(byRate[i].Hash, byRate[j].Hash) < 0
+	})
+
+	picked := make(map[string]bool)
+	skipped := make(map[string]bool) // too big for what's left of the block
+
+	ready := func(entry *MempoolEntry) bool {
+		for _, input := range entry.Txn.Inputs {
+			parent := string(input.PrevHash)
+			if pool.Get(input.PrevHash) != nil && !picked[parent] {
+				return false
+			}
+		}
+		return true
+	}
+
+	// every time we pick a transaction, its children may become ready, so we go
+	// back to the start of the list
+	for found := true; found; {
+		found = false
+		for _, entry := range byRate {
+			hash := string(entry.Hash)
+			if picked[hash] || skipped[hash] || !ready(entry) {
+				continue
+			}
+
+			// an entry's Size is its encoding on its own, which is more than it
+			// adds to the block, so we never go over the limit
+			if len(t.Entries)+2 > maxBlockTxns ||
+				t.SigChecks+len(entry.Txn.Inputs) > maxBlockSigChecks ||
+				t.Bytes+entry.Size > maxBlockBytes {
+				skipped[hash] = true
+				continue
+			}
+
+			picked[hash] = true
+			t.Entries = append(t.Entries, entry)
+			t.Fees += entry.Fee
+			t.Bytes += entry.Size
+			t.SigChecks += len(entry.Txn.Inputs)
+			found = true
+			break
+		}
+	}
+
+	return t
+}
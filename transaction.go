@@ -1,9 +1,6 @@
 package main
 
 import (
-	"crypto"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/gob"
 	"errors"
@@ -12,14 +9,16 @@ import (
 const miningAmount = 10
 
 type TxnInput struct {
-	Key       rsa.PublicKey
+	Key       PublicKey
 	PrevHash  []byte
 	Signature []byte
 }
 
+// coins are paid to an address, and spent by an input giving the public key
+// that hashes to it (and signing with the matching private key)
 type TxnOutput struct {
-	Key    rsa.PublicKey
-	Amount uint64
+	Address Address
+	Amount  uint64
 }
 
 type Transaction struct {
@@ -27,13 +26,12 @@ type Transaction struct {
 	Outputs []TxnOutput
 }
 
-// generates a new payment of 10 coins from mining, returning the transaction
-// and the private key that will be payed if the mining is successful
-func NewMinersTransation() (*Transaction, *rsa.PrivateKey) {
-	priv := genKey()
+// generates a new payment of 10 coins from mining plus the given transaction fees,
+// to the given address if the mining is successful
+func NewMinersTransation(addr Address, fees uint64) *Transaction {
 	txn := &Transaction{}
-	txn.Outputs = append(txn.Outputs, TxnOutput{priv.PublicKey, miningAmount})
-	return txn, priv
+	txn.Outputs = append(txn.Outputs, TxnOutput{addr, miningAmount + fees})
+	return txn
 }
 
 func (txn *Transaction) Hash() []byte {
@@ -41,34 +39,40 @@ func (txn *Transaction) Hash() []byte {
 	encoder := gob.NewEncoder(hasher)
 
 	// transaction hash value does not include signatures (or signing would change the hash,
-	// which would make this impossible) so we save and restore the signature fields
-	tmpSigs := make([][]byte, len(txn.Inputs))
-	for i := range txn.Inputs {
-		tmpSigs[i] = txn.Inputs[i].Signature
-		txn.Inputs[i].Signature = nil
+	// which would make this impossible) so we hash a copy without them. The transaction
+	// itself is left alone, since it may be being encoded for a peer at the same time
+	unsigned := Transaction{Inputs: make([]TxnInput, len(txn.Inputs)), Outputs: txn.Outputs}
+	for i, input := range txn.Inputs {
+		unsigned.Inputs[i] = TxnInput{input.Key, input.PrevHash, nil}
 	}
 
-	err := encoder.Encode(txn)
+	err := encoder.Encode(&unsigned)
 	if err != nil {
 		panic(err)
 	}
 
-	for i := range txn.Inputs {
-		txn.Inputs[i].Signature = tmpSigs[i]
-	}
-
 	return hasher.Sum(nil)
 }
 
-func (txn *Transaction) Sign(wallet map[string]*rsa.PrivateKey) (err error) {
+// the number of bytes the transaction takes up when encoded
+func (txn *Transaction) Size() int {
+	var counter byteCounter
+	err := gob.NewEncoder(&counter).Encode(txn)
+	if err != nil {
+		panic(err)
+	}
+	return int(counter)
+}
+
+func (txn *Transaction) Sign(wallet map[Address]*PrivateKey) (err error) {
 	hash := txn.Hash()
 
 	for i := range txn.Inputs {
-		privKey := wallet[txn.Inputs[i].Key.N.String()]
+		privKey := wallet[AddressOf(&txn.Inputs[i].Key)]
 		if privKey == nil {
 			return errors.New("could not sign transaction, missing private key")
 		}
-		txn.Inputs[i].Signature, err = rsa.SignPKCS1v15(rand.Reader, privKey, crypto.SHA256, hash)
+		txn.Inputs[i].Signature, err = privKey.Sign(hash)
 		if err != nil {
 			return err
 		}
@@ -77,21 +81,42 @@ func (txn *Transaction) Sign(wallet map[string]*rsa.PrivateKey) (err error) {
 	return nil
 }
 
-func (txn *Transaction) VerifySignatures() bool {
+// signs just the inputs whose keys are in the wallet (and aren't signed yet),
+// returning how many it signed, for when other keys are held elsewhere
+func (txn *Transaction) SignAvailable(wallet map[Address]*PrivateKey) (int, error) {
 	hash := txn.Hash()
 
+	signed := 0
 	for i := range txn.Inputs {
-		err := rsa.VerifyPKCS1v15(&txn.Inputs[i].Key, crypto.SHA256, hash, txn.Inputs[i].Signature)
+		privKey := wallet[AddressOf(&txn.Inputs[i].Key)]
+		if privKey == nil || txn.Inputs[i].Signature != nil {
+			continue
+		}
+		sig, err := privKey.Sign(hash)
 		if err != nil {
+			return signed, err
+		}
+		txn.Inputs[i].Signature = sig
+		signed++
+	}
+
+	return signed, nil
+}
+
+func (txn *Transaction) VerifySignatures() bool {
+	hash := txn.Hash()
+
+	for i := range txn.Inputs {
+		if !txn.Inputs[i].Key.Verify(hash, txn.Inputs[i].Signature) {
 			return false
 		}
 	}
 	return true
 }
 
-func (txn *Transaction) OutputAmount(key rsa.PublicKey) (bool, uint64) {
+func (txn *Transaction) OutputAmount(addr Address) (bool, uint64) {
 	for i := range txn.Outputs {
-		if keysEql(&key, &txn.Outputs[i].Key) {
+		if txn.Outputs[i].Address == addr {
 			return true, txn.Outputs[i].Amount
 		}
 	}
@@ -107,6 +132,21 @@ func (txn *Transaction) Total() uint64 {
 	return total
 }
 
+// like Total, but returns false if the total overflows, so that a txn can't
+// create coins by paying out more than there are
+func (txn *Transaction) CheckedTotal() (uint64, bool) {
+	var total uint64
+	for i := range txn.Outputs {
+		var ok bool
+		if total, ok = addAmounts(total, txn.Outputs[i].Amount); !ok {
+			return 0, false
+		}
+	}
+	return total, true
+}
+
+// a miner's transaction creates new coins, so has no inputs; whether it claims
+// the right amount can only be checked in the context of its block
 func (txn *Transaction) IsMiner() bool {
-	return txn.Inputs == nil && len(txn.Outputs) == 1 && txn.Outputs[0].Amount == miningAmount
+	return txn.Inputs == nil && len(txn.Outputs) == 1
 }
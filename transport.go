@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"time"
+)
+
+const dialTimeout = 10 * time.Second
+
+// Transport is how a PeerNetwork listens for and makes connections, so that
+// peers can talk over real sockets or (for tests and simulations) entirely
+// within one process. Addresses are opaque strings interpreted by the transport
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string) (net.Conn, error)
+}
+
+// TCPTransport is the normal transport, over TCP. Addresses are "host:port", where
+// the host may be an IPv4 or IPv6 address or a DNS name; listening on an empty
+// host (eg ":1234") listens on all interfaces, for both IPv4 and IPv6
+type TCPTransport struct{}
+
+func (TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (TCPTransport) Dial(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, dialTimeout)
+}
+
+// DelayTransport wraps another transport, holding up every write on its
+// connections by a random amount of time up to Max in order to simulate a
+// flaky network (and so cause block-chain forks)
+type DelayTransport struct {
+	Transport
+	Max time.Duration
+}
+
+func (t DelayTransport) Listen(addr string) (net.Listener, error) {
+	listener, err := t.Transport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return delayListener{listener, t.Max}, nil
+}
+
+func (t DelayTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := t.Transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return delayConn{conn, t.Max}, nil
+}
+
+type delayListener struct {
+	net.Listener
+	max time.Duration
+}
+
+func (l delayListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return delayConn{conn, l.max}, nil
+}
+
+type delayConn struct {
+	net.Conn
+	max time.Duration
+}
+
+func (c delayConn) Write(b []byte) (int, error) {
+	time.Sleep(time.Duration(rand.Int63n(int64(c.max))))
+	return c.Conn.Write(b)
+}
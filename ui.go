@@ -2,14 +2,20 @@ package main
 
 import (
 	"bufio"
-	"crypto/rsa"
+	"encoding/csv"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// how long to wait for a peer to give us a key to pay to
+const payTimeout = 30 * time.Second
+
 func inputReader(ret chan string) {
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
@@ -29,18 +35,64 @@ func mainLoop() {
 
 	fmt.Print("> ")
 	for text := range input {
-		switch text {
+		cmd, args := "", []string(nil)
+		if fields := strings.Fields(text); len(fields) > 0 {
+			cmd, args = fields[0], fields[1:]
+		}
+
+		switch cmd {
 		case "": // do nothing, ignore
 		case "addr":
-			fmt.Printf("This peer is listening on \"%v\"\n", network.server.Addr())
+			fmt.Printf("This peer is listening on \"%v\"\n", network.Addr())
+			if network.identity != nil {
+				fmt.Printf("Its identity fingerprint is %s\n", network.identity.Fingerprint)
+			}
+		case "peers":
+			printPeers()
 		case "cons":
 			consWallet()
 		case "pay":
-			doPay(input)
+			wait, args, ok := parseWaitFlag(args)
+			if !ok {
+				break
+			}
+			var txn *Transaction
+			if len(args) == 0 {
+				txn = doPay(input)
+			} else {
+				txn = doPayAddress(args)
+			}
+			if txn != nil && wait > 0 {
+				waitForConfirmations(input, txn, wait)
+			}
+		case "paymany":
+			doPayMany(args)
+		case "coins":
+			setCoinSelector(args)
+		case "receive":
+			newAddress()
+		case "bump":
+			doBump(input, args)
 		case "state":
 			printState()
+		case "mempool":
+			printMempool()
+		case "template":
+			printTemplate()
+		case "conflicts":
+			printConflicts()
 		case "wallet":
 			printWallet()
+		case "seed":
+			printSeed()
+		case "history":
+			printHistory(args)
+		case "txn":
+			doTxn(input, args)
+		case "watch":
+			doWatch(args)
+		case "unwatch":
+			doUnwatch(args)
 		case "help":
 			printHelp()
 		case "quit":
@@ -57,10 +109,10 @@ func consWallet() {
 	var total uint64
 	txn := new(Transaction)
 
-	for key, amount := range state.GetWallet() {
+	for addr, amount := range state.GetWallet() {
 		if amount > 0 {
 			total += amount
-			txn.Inputs = append(txn.Inputs, state.GenTxnInput(key))
+			txn.Inputs = append(txn.Inputs, state.GenTxnInput(addr))
 		}
 	}
 
@@ -69,14 +121,13 @@ func consWallet() {
 		return
 	}
 
-	key := genKey()
-	txn.Outputs = append(txn.Outputs, TxnOutput{key.PublicKey, total})
+	key := state.NewKey(branchChange)
+	txn.Outputs = append(txn.Outputs, TxnOutput{AddressOf(&key.PublicKey), total})
 
 	state.Sign(txn)
 
 	success := state.AddTxn(txn)
 	if success {
-		state.AddToWallet(key)
 		network.BroadcastTxn(txn)
 		fmt.Println("Wallet consolidated.")
 	} else {
@@ -85,13 +136,106 @@ func consWallet() {
 }
 
 func printWallet() {
-	fmt.Printf("\n  Amount | Public Key\n")
+	fmt.Printf("\n  Amount | Address\n")
 	var total uint64
-	for key, val := range state.GetWallet() {
-		fmt.Printf("%8d | %s...\n", val, key.N.String()[0:40])
+	for addr, val := range state.GetWallet() {
+		fmt.Printf("%8d | %s\n", val, addr)
 		total += val
 	}
 	fmt.Printf("\nTotal Coins: %d\n\n", total)
+
+	watched := state.GetWatched()
+	if len(watched) == 0 {
+		return
+	}
+	fmt.Printf("  Amount | Watch-only Address (can't be spent from here)\n")
+	total = 0
+	for addr, val := range watched {
+		fmt.Printf("%8d | %s\n", val, addr)
+		total += val
+	}
+	fmt.Printf("\nTotal Watch-only Coins: %d\n\n", total)
+}
+
+func printHistory(args []string) {
+	watchOnly := len(args) == 1 && args[0] == "watch"
+	if len(args) > 0 && !watchOnly {
+		fmt.Println("Usage: history [watch]")
+		return
+	}
+	history := state.History(watchOnly)
+
+	if watchOnly {
+		fmt.Printf("\n%d Watch-only Transactions\n\n", len(history))
+	} else {
+		fmt.Printf("\n%d Wallet Transactions\n\n", len(history))
+	}
+	if len(history) > 0 {
+		fmt.Println("       Confs | Hash          |   Amount | With")
+	}
+	for _, entry := range history {
+		confs := entry.Status.String()
+		if entry.Status == TxnConfirmed {
+			confs = strconv.Itoa(entry.Confirmations)
+		}
+
+		var with string
+		switch {
+		case entry.Txn.IsMiner():
+			with = "mining reward"
+		case len(entry.Counterparties) == 0:
+			with = "yourself"
+		default:
+			with = entry.Counterparties[0].String()
+			if len(entry.Counterparties) > 1 {
+				with += fmt.Sprintf(" and %d more", len(entry.Counterparties)-1)
+			}
+		}
+
+		fmt.Printf("  %10s | %x  | %+8d | %s\n", confs, entry.Hash[:6], entry.Net(), with)
+	}
+	fmt.Println()
+}
+
+func printPeers() {
+	statuses := network.PeerStatuses()
+
+	addrs := make([]string, 0, len(statuses))
+	for addr := range statuses {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	fmt.Printf("\n%d Connected Peers\n\n", len(addrs))
+	for _, addr := range addrs {
+		status := statuses[addr]
+		if status.Latency == 0 {
+			fmt.Printf("  %-24s %10s", addr, "-")
+		} else {
+			fmt.Printf("  %-24s %8.1fms", addr, float64(status.Latency)/float64(time.Millisecond))
+		}
+		if status.Remote != addr {
+			fmt.Printf("  (connected from %s)", status.Remote)
+		}
+		fmt.Println()
+	}
+
+	var known []AddrEntry
+	for _, entry := range network.book.Entries() {
+		if _, ok := statuses[entry.Addr]; !ok {
+			known = append(known, entry)
+		}
+	}
+
+	fmt.Printf("\n%d Other Known Peers\n\n", len(known))
+	for _, entry := range known {
+		if entry.LastSeen.IsZero() {
+			fmt.Printf("  %-24s never seen\n", entry.Addr)
+		} else {
+			fmt.Printf("  %-24s last seen %v ago\n", entry.Addr, time.Since(entry.LastSeen).Round(time.Second))
+		}
+	}
+	fmt.Println()
 }
 
 func printState() {
@@ -103,19 +247,106 @@ func printState() {
 
 	fmt.Printf("\n%d Alternate Chains\n", len(state.alternates))
 
-	fmt.Printf("\n%d Transactions Being Mined (+1 miner's fee)\n", state.beingMined-1)
-	for _, txn := range state.pendingTxns[:state.beingMined-1] {
+	var mining []*Transaction
+	if state.beingMined != nil {
+		mining = state.beingMined.Txns[1:]
+	}
+
+	fmt.Printf("\n%d Transactions Being Mined (+1 miner's fee)\n", len(mining))
+	for _, txn := range mining {
 		printTxn(txn)
 	}
 
-	fmt.Printf("\n%d Transactions Pending\n", len(state.pendingTxns)+1-state.beingMined)
-	for _, txn := range state.pendingTxns[state.beingMined-1:] {
+	// anything else in the mempool is waiting for the next block
+	inBlock := make(map[*Transaction]bool)
+	for _, txn := range mining {
+		inBlock[txn] = true
+	}
+	var pending []*Transaction
+	for _, txn := range state.mempool.Txns() {
+		if !inBlock[txn] {
+			pending = append(pending, txn)
+		}
+	}
+
+	fmt.Printf("\n%d Transactions Pending\n", len(pending))
+	for _, txn := range pending {
 		printTxn(txn)
 	}
 
 	fmt.Println()
 }
 
+func printMempool() {
+	entries := state.MempoolEntries()
+
+	var bytes int
+	for _, entry := range entries {
+		bytes += entry.Size
+	}
+	fmt.Printf("\n%d Transactions Pending (%d bytes)\n\n", len(entries), bytes)
+
+	if len(entries) > 0 {
+		fmt.Println("  Hash          |  Bytes |  Fee | Fee/kB |    Age")
+	}
+	for _, entry := range entries {
+		fmt.Printf("  %x  | %6d | %4d | %6.2f | %6v | ", entry.Hash[:6],
+			entry.Size, entry.Fee, entry.FeeRate(), time.Since(entry.Added).Round(time.Second))
+		printTxn(entry.Txn)
+	}
+
+	orphans := state.OrphanEntries()
+	fmt.Printf("\n%d Orphan Transactions (waiting for parents)\n\n", len(orphans))
+	for _, entry := range orphans {
+		fmt.Printf("  %x  | waiting %v for %d | ", entry.Hash[:6],
+			time.Since(entry.Added).Round(time.Second), len(entry.Missing))
+		printTxn(entry.Txn)
+	}
+	fmt.Println()
+}
+
+func printTemplate() {
+	template := state.BlockTemplate()
+
+	fmt.Printf("\nNext block would hold %d of %d pending txns (+1 miner's fee)\n",
+		len(template.Entries), len(state.MempoolEntries()))
+	fmt.Printf("  %7d of %7d bytes\n", template.Bytes, maxBlockBytes)
+	fmt.Printf("  %7d of %7d txns\n", len(template.Entries)+1, maxBlockTxns)
+	fmt.Printf("  %7d of %7d signature checks\n", template.SigChecks, maxBlockSigChecks)
+	fmt.Printf("  %7d coins in fees\n\n", template.Fees)
+
+	for _, entry := range template.Entries {
+		fmt.Printf("  %x  | %6.2f/kB | ", entry.Hash[:6], entry.FeeRate())
+		printTxn(entry.Txn)
+	}
+	fmt.Println()
+}
+
+func printConflicts() {
+	conflicts := state.Conflicts()
+
+	fmt.Printf("\n%d Double-Spends Seen\n\n", len(conflicts))
+	for _, conflict := range conflicts {
+		var spent []string
+		for _, addr := range conflict.Spent {
+			spent = append(spent, addr.String())
+		}
+		fmt.Printf("  %v ago: txn %x %s in favour of %x, both spending %s",
+			time.Since(conflict.Time).Round(time.Second), conflict.Dropped.Hash()[:6],
+			conflict.Kind, conflict.Kept.Hash()[:6], strings.Join(spent, ", "))
+		if conflict.Lost > 0 {
+			fmt.Printf(" (you lost %d coins)", conflict.Lost)
+		}
+		fmt.Println()
+	}
+	fmt.Println()
+}
+
+// prints something the user needs to know about as soon as it happens
+func alertUser(msg string) {
+	fmt.Printf("\n*** %s ***\n", msg)
+}
+
 func printBlockChain(chain *BlockChain) {
 	if len(chain.Blocks) > 0 {
 		fmt.Println()
@@ -135,8 +366,8 @@ func printBlockChain(chain *BlockChain) {
 
 func printTxn(txn *Transaction) {
 	if txn.IsMiner() {
-		fmt.Printf("Txn mined %d coins for %s\n", miningAmount,
-			txn.Outputs[0].Key.N.String()[:8])
+		fmt.Printf("Txn mined %d coins for %s\n", txn.Outputs[0].Amount,
+			txn.Outputs[0].Address)
 		return
 	}
 
@@ -146,24 +377,24 @@ func printTxn(txn *Transaction) {
 			len(txn.Inputs), txn.Total())
 	case 1:
 		fmt.Printf("Txn from %d keys payed %d coins to %s\n",
-			len(txn.Inputs), txn.Total(), txn.Outputs[0].Key.N.String()[:8])
+			len(txn.Inputs), txn.Total(), txn.Outputs[0].Address)
 	default:
 		fmt.Printf("Txn from %d keys payed ", len(txn.Inputs))
 		for i := range txn.Outputs[:len(txn.Outputs)-1] {
-			fmt.Printf("%d to %s, ", txn.Outputs[i].Amount, txn.Outputs[i].Key.N.String()[:8])
+			fmt.Printf("%d to %s, ", txn.Outputs[i].Amount, txn.Outputs[i].Address)
 		}
-		fmt.Printf("%d to %s\n", txn.Outputs[len(txn.Outputs)-1].Amount, txn.Outputs[len(txn.Outputs)-1].Key.N.String()[:8])
+		fmt.Printf("%d to %s\n", txn.Outputs[len(txn.Outputs)-1].Amount, txn.Outputs[len(txn.Outputs)-1].Address)
 	}
 }
 
-func doPay(input chan string) {
+func doPay(input chan string) *Transaction {
 	peers := network.PeerAddrList()
 	if len(peers) < 1 {
 		fmt.Println("No connected peers to pay.")
-		return
+		return nil
 	}
 
-	interrupt := make(chan os.Signal)
+	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
 	defer signal.Stop(interrupt)
 	defer close(interrupt)
@@ -187,7 +418,7 @@ func doPay(input chan string) {
 				peer = peers[i-1]
 			}
 		case <-interrupt:
-			return
+			return nil
 		}
 	}
 
@@ -209,74 +440,905 @@ func doPay(input chan string) {
 				amount = uint64(i)
 			}
 		case <-interrupt:
-			return
+			return nil
+		}
+	}
+
+	var fee uint64
+	feeChosen := false
+	fmt.Println("Pay what fee to the miner? (Higher fees get mined sooner)")
+	fmt.Println("Enter just the value (eg \"1\"), or nothing for no fee")
+	for !feeChosen {
+		fmt.Print(">> ")
+		select {
+		case text := <-input:
+			if text == "" {
+				feeChosen = true
+				break
+			}
+			i, err := strconv.ParseInt(text, 10, 64)
+			if err != nil || i < 0 || uint64(i) > total-amount {
+				fmt.Println("Invalid input")
+			} else {
+				fee = uint64(i)
+				feeChosen = true
+			}
+		case <-interrupt:
+			return nil
 		}
 	}
 
 	expect, err := network.RequestPayableAddress(peer)
 	if err != nil {
 		fmt.Print(err)
-		return
+		return nil
 	}
 
-	var key *rsa.PublicKey
+	var payTo *Address
 	select {
-	case key = <-expect:
+	case payTo = <-expect:
+	case <-time.After(payTimeout):
+		network.CancelPayExpectation(peer)
+		fmt.Println("Timed out waiting for peer.")
+		return nil
 	case <-interrupt:
 		network.CancelPayExpectation(peer)
+		return nil
 	}
 
-	txn := new(Transaction)
+	if payTo == nil {
+		fmt.Println("Peer disconnected.")
+		return nil
+	}
+	if *payTo == (Address{}) {
+		fmt.Println(errPayRefused)
+		return nil
+	}
 
-	total = 0
-	for key, val := range state.GetWallet() {
-		if val > 0 {
-			total += val
-			txn.Inputs = append(txn.Inputs, state.GenTxnInput(key))
+	return sendPayment([]TxnOutput{{*payTo, amount}}, fee)
+}
+
+// pays amount coins (plus fee) to the given address, with no need for whoever
+// owns it to be online
+func doPayAddress(args []string) *Transaction {
+	if len(args) < 2 || len(args) > 3 {
+		fmt.Println("Usage: pay [--wait-confirmations=N] <address> <amount> [fee]")
+		return nil
+	}
+
+	payTo, err := ParseAddress(args[0])
+	if err != nil {
+		fmt.Println(err)
+		return nil
+	}
+
+	amount, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil || amount == 0 {
+		fmt.Println("Invalid amount")
+		return nil
+	}
+
+	var fee uint64
+	if len(args) == 3 {
+		fee, err = strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			fmt.Println("Invalid fee")
+			return nil
+		}
+	}
+
+	return sendPayment([]TxnOutput{{payTo, amount}}, fee)
+}
+
+// prints an error and returns false if any of the payments is to an address that
+// already holds coins, or if two are to the same address: an address only holds
+// the coins from one txn, so paying it again would lose what is already there
+func checkPayees(payments []TxnOutput) bool {
+	paid := make(map[Address]bool)
+	for _, payment := range payments {
+		if paid[payment.Address] {
+			fmt.Printf("%s is paid twice, please combine the payments.\n", payment.Address)
+			return false
 		}
-		if total >= amount {
-			break
+		if state.AddressFunded(payment.Address) {
+			fmt.Printf("%s already holds coins, paying it again would destroy them. Ask for a new address.\n", payment.Address)
+			return false
 		}
+		paid[payment.Address] = true
+	}
+	return true
+}
+
+// returns the total of the payments, and false if that plus the fee is more than
+// the given coins add up to. Amounts are typed in, so any of these sums can
+// overflow; that is never enough coins either
+func paymentTotal(payments []TxnOutput, fee uint64, coins []Coin) (uint64, bool) {
+	var amount uint64
+	var ok bool
+	for _, payment := range payments {
+		if amount, ok = addAmounts(amount, payment.Amount); !ok {
+			return 0, false
+		}
+	}
+	needed, ok := addAmounts(amount, fee)
+	if !ok {
+		return 0, false
+	}
+
+	var available uint64
+	for _, coin := range coins {
+		available += coin.Amount
+	}
+	return amount, needed <= available
+}
+
+// builds, signs and broadcasts a single txn making all the given payments from
+// our wallet, with any change going to a new address of ours. Returns the txn,
+// or nil if it couldn't be sent
+func sendPayment(payments []TxnOutput, fee uint64) *Transaction {
+	if !checkPayees(payments) {
+		return nil
+	}
+	txn := new(Transaction)
+
+	wallet := state.WalletCoins()
+	amount, ok := paymentTotal(payments, fee, wallet)
+	if !ok {
+		fmt.Println("Not enough coins in your wallet.")
+		return nil
+	}
+
+	coins := coinSelector.Select(wallet, amount+fee)
+	if coins == nil {
+		fmt.Println("Not enough coins in your wallet.")
+		return nil
+	}
+
+	var total uint64
+	for _, coin := range coins {
+		total += coin.Amount
+		txn.Inputs = append(txn.Inputs, state.GenTxnInput(coin.Address))
 	}
 
-	txn.Outputs = append(txn.Outputs, TxnOutput{*key, amount})
-	var change *rsa.PrivateKey
-	if total > amount {
+	txn.Outputs = append(txn.Outputs, payments...)
+	if total > amount+fee {
 		// calculate change
-		change = genKey()
-		txn.Outputs = append(txn.Outputs, TxnOutput{change.PublicKey, total - amount})
+		change := state.NewKey(branchChange)
+		txn.Outputs = append(txn.Outputs, TxnOutput{AddressOf(&change.PublicKey), total - amount - fee})
 	}
 
-	err = state.Sign(txn)
+	err := state.Sign(txn)
 	if err != nil {
 		fmt.Print(err)
+		return nil
+	}
+
+	if !state.AddTxn(txn) {
+		fmt.Println("Failed, please try again.")
+		return nil
+	}
+	network.BroadcastTxn(txn)
+	fmt.Printf("Payment sent in txn %x.\n", txn.Hash()[:6])
+	return txn
+}
+
+// takes a leading --wait-confirmations=N off the arguments to pay, returning N
+// (or 0 if it isn't there) and the other arguments
+func parseWaitFlag(args []string) (int, []string, bool) {
+	const flag = "--wait-confirmations="
+	if len(args) == 0 || !strings.HasPrefix(args[0], flag) {
+		return 0, args, true
+	}
+
+	n, err := strconv.Atoi(strings.TrimPrefix(args[0], flag))
+	if err != nil || n < 1 {
+		fmt.Println("Invalid number of confirmations to wait for")
+		return 0, nil, false
+	}
+	return n, args[1:], true
+}
+
+// waits until txn has the given number of confirmations, or can't get them, or
+// the user gets bored (and presses enter or ctrl-c)
+func waitForConfirmations(input chan string, txn *Transaction, confirmations int) {
+	hash := txn.Hash()
+	done, cancel := state.WaitForTxn(hash, confirmations)
+	defer cancel()
+	if done == nil {
 		return
 	}
 
-	success := state.AddTxn(txn)
-	if success {
-		if change != nil {
-			state.AddToWallet(change)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	defer close(interrupt)
+
+	fmt.Printf("Waiting for %d confirmations of txn %x (press enter to stop waiting)...\n",
+		confirmations, hash[:6])
+	select {
+	case tracked := <-done:
+		if tracked.Failed() {
+			fmt.Printf("Txn %x was %s, and won't be confirmed.\n", hash[:6], tracked.Status)
+		} else {
+			fmt.Printf("Txn %x has %d confirmations.\n", hash[:6], tracked.Confirmations)
+		}
+	case <-input:
+		fmt.Println("Stopped waiting, see history for how the txn is getting on.")
+	case <-interrupt:
+		fmt.Println()
+	}
+}
+
+// pays many recipients at once, each of which may be an address or the network
+// address of a connected peer (which is asked for an address to pay to). They
+// are given either as arguments, or in a CSV file of recipient,amount lines
+func doPayMany(args []string) {
+	var fee uint64
+	var err error
+	if len(args)%2 == 1 {
+		fee, err = strconv.ParseUint(args[len(args)-1], 10, 64)
+		if err != nil {
+			fmt.Println("Invalid fee")
+			return
+		}
+		args = args[:len(args)-1]
+	}
+
+	var pairs [][]string
+	if len(args) == 2 && args[0] == "-f" {
+		pairs, err = readPaymentsFile(args[1])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	} else {
+		for i := 0; i+1 < len(args); i += 2 {
+			pairs = append(pairs, args[i:i+2])
+		}
+	}
+	if len(pairs) == 0 {
+		fmt.Println("Usage: paymany <recipient> <amount> [<recipient> <amount> ...] [fee]")
+		fmt.Println("   or: paymany -f <file.csv> [fee]")
+		return
+	}
+
+	// the same recipient may appear more than once, but each address can only
+	// be paid once in a txn (and we only ask each peer for one address)
+	amounts := make(map[string]uint64)
+	var recipients []string
+	var total uint64
+	for _, pair := range pairs {
+		amount, err := strconv.ParseUint(pair[1], 10, 64)
+		if err != nil || amount == 0 {
+			fmt.Printf("Invalid amount %q for %s\n", pair[1], pair[0])
+			return
+		}
+		if _, ok := amounts[pair[0]]; !ok {
+			recipients = append(recipients, pair[0])
+		}
+		// no recipient's amount can overflow if the total doesn't
+		var ok bool
+		if total, ok = addAmounts(total, amount); !ok {
+			fmt.Println("Not enough coins in your wallet.")
+			return
+		}
+		amounts[pair[0]] += amount
+	}
+
+	// check before asking any peers for addresses
+	if _, ok := paymentTotal([]TxnOutput{{Amount: total}}, fee, state.WalletCoins()); !ok {
+		fmt.Println("Not enough coins in your wallet.")
+		return
+	}
+
+	payTo := make(map[string]Address)
+	expects := make(map[string]chan *Address)
+	cancel := func() {
+		for peer := range expects {
+			network.CancelPayExpectation(peer)
+		}
+	}
+
+	for _, recipient := range recipients {
+		if addr, err := ParseAddress(recipient); err == nil {
+			payTo[recipient] = addr
+			continue
+		}
+		if network.Peer(recipient) == nil {
+			fmt.Printf("%s is neither a valid address nor a connected peer\n", recipient)
+			cancel()
+			return
+		}
+		expect, err := network.RequestPayableAddress(recipient)
+		if err != nil {
+			fmt.Println(err)
+			cancel()
+			return
+		}
+		expects[recipient] = expect
+	}
+
+	timeout := time.After(payTimeout)
+	for peer, expect := range expects {
+		select {
+		case addr := <-expect:
+			if addr == nil {
+				fmt.Printf("Peer %s disconnected.\n", peer)
+				cancel()
+				return
+			}
+			if *addr == (Address{}) {
+				fmt.Printf("Peer %s: %v\n", peer, errPayRefused)
+				cancel()
+				return
+			}
+			payTo[peer] = *addr
+		case <-timeout:
+			cancel()
+			fmt.Println("Timed out waiting for peers.")
+			return
+		}
+	}
+
+	// two recipients (eg a peer and the address it gave us) may still turn out
+	// to be the same address. Merging them can't overflow, as the total has
+	// been checked
+	var payments []TxnOutput
+	for _, recipient := range recipients {
+		merged := false
+		for i := range payments {
+			if payments[i].Address == payTo[recipient] {
+				payments[i].Amount += amounts[recipient]
+				merged = true
+			}
+		}
+		if !merged {
+			payments = append(payments, TxnOutput{payTo[recipient], amounts[recipient]})
+		}
+	}
+
+	sendPayment(payments, fee)
+}
+
+// reads recipient,amount pairs from a CSV file, skipping blank lines, lines
+// starting with # and a header line if there is one. Any columns after the
+// first two (eg the recipient's name) are ignored
+func readPaymentsFile(path string) ([][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var pairs [][]string
+	for i, record := range records {
+		if len(record) < 2 {
+			return nil, fmt.Errorf("%s: expected recipient,amount on every line", path)
 		}
+		if _, err := strconv.ParseUint(record[1], 10, 64); err != nil && i == 0 {
+			continue // a header
+		}
+		pairs = append(pairs, record[:2])
+	}
+	return pairs, nil
+}
+
+// shows or changes how we choose which coins to spend
+func setCoinSelector(args []string) {
+	var names []string
+	for name := range coinSelectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(args) == 1 {
+		selector, ok := coinSelectors[args[0]]
+		if !ok {
+			fmt.Printf("Unknown strategy %q, choose one of: %s\n", args[0], strings.Join(names, ", "))
+			return
+		}
+		coinSelector = selector
+	} else if len(args) > 1 {
+		fmt.Println("Usage: coins [strategy]")
+		return
+	}
+
+	for _, name := range names {
+		if coinSelectors[name] == coinSelector {
+			fmt.Printf("Choosing coins to spend by strategy %q (of %s)\n", name, strings.Join(names, ", "))
+		}
+	}
+}
+
+// makes a new address for someone to pay us at
+func newAddress() {
+	key := state.NewKey(branchReceive)
+	fmt.Println("Your new address is", AddressOf(&key.PublicKey))
+	fmt.Println("Its public key (for watching it elsewhere) is", &key.PublicKey)
+}
+
+// parses an address or a public key to watch, returning the key if there is one
+func parseWatchEntry(s string) (Address, *PublicKey, error) {
+	if strings.Contains(s, ":") {
+		key, err := ParsePublicKey(s)
+		if err != nil {
+			return Address{}, nil, err
+		}
+		return AddressOf(key), key, nil
+	}
+	addr, err := ParseAddress(s)
+	return addr, nil, err
+}
+
+// starts watching the given addresses and public keys
+func doWatch(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: watch <address or public key> ...")
+		return
+	}
+
+	for _, arg := range args {
+		addr, key, err := parseWatchEntry(arg)
+		if err == nil {
+			err = state.Watch(addr, key)
+		}
+		if err != nil {
+			fmt.Printf("%s: %v\n", arg, err)
+			continue
+		}
+		fmt.Println("Watching", addr)
+	}
+}
+
+// watches every address or public key listed in a file, one per line (blank
+// lines and lines starting with # are skipped)
+func watchFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		addr, key, err := parseWatchEntry(text)
+		if err == nil {
+			err = state.Watch(addr, key)
+		}
+		if err != nil {
+			return fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func doUnwatch(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: unwatch <address>")
+		return
+	}
+
+	addr, _, err := parseWatchEntry(args[0])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if !state.Unwatch(addr) {
+		fmt.Println("That address isn't being watched.")
+	}
+}
+
+// creates, signs or broadcasts a txn kept in a file, so that a txn spending from
+// watched addresses can be signed by a peer holding their keys that isn't
+// connected to the network
+func doTxn(input chan string, args []string) {
+	if len(args) < 2 {
+		fmt.Println("Usage: txn create <file> <change address> <address> <amount> ... [fee]")
+		fmt.Println("       txn sign <file>")
+		fmt.Println("       txn broadcast <file>")
+		return
+	}
+
+	switch args[0] {
+	case "create":
+		createTxn(args[1], args[2:])
+	case "sign":
+		signTxn(input, args[1])
+	case "broadcast":
+		broadcastTxn(args[1])
+	default:
+		fmt.Println("Unknown txn command, try create, sign or broadcast")
+	}
+}
+
+// writes an unsigned txn paying the given addresses from the watched addresses
+// whose public keys we know. We can't make new addresses for the peer that holds
+// the keys, so it has to give us one for the change
+func createTxn(path string, args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: txn create <file> <change address> <address> <amount> ... [fee]")
+		return
+	}
+	change, err := ParseAddress(args[0])
+	if err != nil {
+		fmt.Printf("%s: %v\n", args[0], err)
+		return
+	}
+	if state.AddressUsed(change) {
+		fmt.Printf("Change address %s has been used before, ask the signing wallet for a new one.\n", change)
+		return
+	}
+	args = args[1:]
+
+	var fee uint64
+	if len(args)%2 == 1 {
+		fee, err = strconv.ParseUint(args[len(args)-1], 10, 64)
+		if err != nil {
+			fmt.Println("Invalid fee")
+			return
+		}
+		args = args[:len(args)-1]
+	}
+	if len(args) == 0 {
+		fmt.Println("Usage: txn create <file> <change address> <address> <amount> ... [fee]")
+		return
+	}
+
+	var payments []TxnOutput
+	var amount uint64
+	for i := 0; i < len(args); i += 2 {
+		addr, err := ParseAddress(args[i])
+		if err != nil {
+			fmt.Printf("%s: %v\n", args[i], err)
+			return
+		}
+		n, err := strconv.ParseUint(args[i+1], 10, 64)
+		if err != nil || n == 0 {
+			fmt.Printf("Invalid amount %q\n", args[i+1])
+			return
+		}
+		payments = append(payments, TxnOutput{addr, n})
+	}
+
+	if !checkPayees(append(payments, TxnOutput{change, 0})) {
+		return
+	}
+
+	watched := state.WatchedCoins()
+	amount, ok := paymentTotal(payments, fee, watched)
+	if !ok {
+		fmt.Println("Not enough coins at watched addresses with known public keys.")
+		return
+	}
+
+	coins := coinSelector.Select(watched, amount+fee)
+	if coins == nil {
+		fmt.Println("Not enough coins at watched addresses with known public keys.")
+		return
+	}
+
+	txn := new(Transaction)
+	var prevs []*Transaction
+	var total uint64
+	for _, coin := range coins {
+		total += coin.Amount
+		prevs = append(prevs, state.FundingTxn(coin.Address))
+		txn.Inputs = append(txn.Inputs, state.GenTxnInput(coin.Address))
+	}
+	txn.Outputs = append(txn.Outputs, payments...)
+
+	if total > amount+fee {
+		txn.Outputs = append(txn.Outputs, TxnOutput{change, total - amount - fee})
+	}
+
+	if err := NewPartialTxn(txn, prevs).Write(path); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("Wrote unsigned txn %x (%d inputs) to %s.\n", txn.Hash()[:6], len(txn.Inputs), path)
+}
+
+// once the user agrees, signs whichever inputs of the txn in the file spend from
+// our wallet, writing the result back to the file
+func signTxn(input chan string, path string) {
+	partial, err := ReadPartialTxn(path)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	txn, err := partial.Transaction()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// we may not have seen the coins being spent (we needn't even be connected to
+	// the network), so the amounts are checked against the txns they come from
+	amounts, checked, err := partial.Amounts()
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("Not signing: the file may have been tampered with.")
+		return
+	}
+	var in uint64
+	for _, amount := range amounts {
+		in += amount
+	}
+	fmt.Printf("Txn %x spends %d coins from %d addresses, paying:\n", txn.Hash()[:6], in, len(txn.Inputs))
+	for _, output := range txn.Outputs {
+		mine := ""
+		if state.InWallet(output.Address) {
+			mine = " (yours)"
+		}
+		fmt.Printf("  %8d to %s%s\n", output.Amount, output.Address, mine)
+	}
+	if in >= txn.Total() {
+		fmt.Printf("  %8d fee\n", in-txn.Total())
+	}
+	if !checked {
+		fmt.Println("WARNING: the file doesn't include the txns that some inputs spend from, so")
+		fmt.Println("the amounts they spend (and so the fee) are only what its creator claims.")
+		fmt.Println("Every input spends all the coins at its address, whatever is shown here.")
+	}
+
+	if !confirmSigning(input) {
+		fmt.Println("Not signed.")
+		return
+	}
+
+	signed, err := state.SignAvailable(txn)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if signed == 0 {
+		fmt.Println("None of the unsigned inputs spend from this wallet.")
+		return
+	}
+
+	partial.SetSignatures(txn)
+	if err := partial.Write(path); err != nil {
+		fmt.Println(err)
+		return
+	}
+	unsigned := 0
+	for _, input := range txn.Inputs {
+		if input.Signature == nil {
+			unsigned++
+		}
+	}
+	fmt.Printf("Signed %d inputs (%d still unsigned), and wrote the txn back to %s.\n", signed, unsigned, path)
+}
+
+// asks whether to go ahead and sign, returning true if so
+func confirmSigning(input chan string) bool {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	defer close(interrupt)
+
+	for {
+		fmt.Print("Sign it? (y/n) >> ")
+		select {
+		case text := <-input:
+			switch strings.ToLower(strings.TrimSpace(text)) {
+			case "y", "yes":
+				return true
+			case "n", "no":
+				return false
+			}
+			fmt.Println("Invalid input")
+		case <-interrupt:
+			fmt.Println()
+			return false
+		}
+	}
+}
+
+// sends the fully-signed txn in the file to the network
+func broadcastTxn(path string) {
+	partial, err := ReadPartialTxn(path)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	txn, err := partial.Transaction()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	for i, input := range txn.Inputs {
+		if input.Signature == nil {
+			fmt.Printf("Input %d isn't signed yet, see txn sign.\n", i+1)
+			return
+		}
+	}
+	if !txn.VerifySignatures() {
+		fmt.Println("The txn's signatures are invalid (was it changed after signing?).")
+		return
+	}
+
+	if !state.AddTxn(txn) {
+		fmt.Println("The txn was rejected: its coins may already be spent, or its fee be too low.")
+		return
+	}
+	network.BroadcastTxn(txn)
+	fmt.Printf("Broadcast txn %x.\n", txn.Hash()[:6])
+}
+
+// replaces one of our pending transactions with one paying a higher fee, taking
+// the extra from its change (or from the rest of the wallet if need be)
+func doBump(input chan string, args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: bump <txid> (see 'mempool' for txids)")
+		return
+	}
+
+	var entry *MempoolEntry
+	for _, e := range state.MempoolEntries() {
+		if strings.HasPrefix(fmt.Sprintf("%x", e.Hash), strings.ToLower(args[0])) {
+			if entry != nil {
+				fmt.Println("More than one pending txn matches, give more of the txid.")
+				return
+			}
+			entry = e
+		}
+	}
+	if entry == nil {
+		fmt.Println("No pending txn matches.")
+		return
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	defer close(interrupt)
+	defer fmt.Println()
+
+	// the replacement has to pay more than everything it replaces, which
+	// includes any pending txns spending from this one
+	replacing := state.MempoolDescendants(entry)
+	if len(replacing) == 0 {
+		fmt.Println("That txn is no longer pending.")
+		return
+	}
+	var minFee uint64
+	for _, e := range replacing {
+		minFee += e.Fee
+	}
+
+	var fee uint64
+	fmt.Println("Pay what fee instead? (It currently pays", minFee, "and must pay more)")
+	if len(replacing) > 1 {
+		fmt.Println("That includes the fees of the", len(replacing)-1, "pending txns spending from it.")
+	}
+	fmt.Println("Enter just the value (eg \"2\")")
+	for fee == 0 {
+		fmt.Print(">> ")
+		select {
+		case text := <-input:
+			i, err := strconv.ParseInt(text, 10, 64)
+			if err != nil || i < 1 || uint64(i) <= minFee {
+				fmt.Println("Invalid input")
+			} else {
+				fee = uint64(i)
+			}
+		case <-interrupt:
+			return
+		}
+	}
+
+	txn := new(Transaction)
+	var change uint64
+	for _, in := range entry.Txn.Inputs {
+		txn.Inputs = append(txn.Inputs, TxnInput{in.Key, in.PrevHash, nil})
+	}
+	for _, out := range entry.Txn.Outputs {
+		if state.InWallet(out.Address) {
+			change += out.Amount
+		} else {
+			txn.Outputs = append(txn.Outputs, out)
+		}
+	}
+
+	// the wallet includes the outputs of the txns being replaced, which the
+	// replacement obviously can't spend
+	extra := fee - entry.Fee
+	if change < extra {
+		var spendable []Coin
+		for _, coin := range state.WalletCoins() {
+			replaced := false
+			for _, e := range replacing {
+				if found, _ := e.Txn.OutputAmount(coin.Address); found {
+					replaced = true
+				}
+			}
+			if !replaced {
+				spendable = append(spendable, coin)
+			}
+		}
+		for _, coin := range coinSelector.Select(spendable, extra-change) {
+			change += coin.Amount
+			txn.Inputs = append(txn.Inputs, state.GenTxnInput(coin.Address))
+		}
+	}
+	if change < extra {
+		fmt.Println("Not enough coins in your wallet to pay that fee.")
+		return
+	}
+
+	if change > extra {
+		changeKey := state.NewKey(branchChange)
+		txn.Outputs = append(txn.Outputs, TxnOutput{AddressOf(&changeKey.PublicKey), change - extra})
+	}
+
+	err := state.Sign(txn)
+	if err != nil {
+		fmt.Println("Can only bump your own transactions:", err)
+		return
+	}
+
+	if state.AddTxn(txn) {
 		network.BroadcastTxn(txn)
-		fmt.Println("Payment sent.")
+		fmt.Printf("Replaced txn %x with %x.\n", entry.Hash[:6], txn.Hash()[:6])
 	} else {
 		fmt.Println("Failed, please try again.")
 	}
 }
 
+func printSeed() {
+	seed := state.Seed()
+	if seed == nil {
+		fmt.Println("This wallet's keys are random, so it can't be recovered (see --seed).")
+		return
+	}
+	fmt.Println("Seed phrase:", seed.Phrase())
+	fmt.Println("Anyone with this phrase can spend your coins, keep it secret.")
+}
+
 func printHelp() {
 	fmt.Println()
 	fmt.Println("Possible commands are:")
 	fmt.Println()
-	fmt.Println("  state  - display blockchain and transaction state")
-	fmt.Println("  wallet - display wallet")
+	fmt.Println("  state     - display blockchain and transaction state")
+	fmt.Println("  mempool   - display transactions waiting to be mined")
+	fmt.Println("  template  - display the transactions that would be mined next")
+	fmt.Println("  conflicts - display double-spends seen")
+	fmt.Println("  wallet    - display wallet")
+	fmt.Println("  history   - display the transactions paying or paid from your wallet")
+	fmt.Println("              (or history watch for the watch-only addresses)")
+	fmt.Println("  seed      - display the seed phrase the wallet can be recovered from")
 	fmt.Println()
-	fmt.Println("  cons   - consolidate wallet into a single key")
-	fmt.Println("  pay    - perform a payment to another peer")
+	fmt.Println("  cons      - consolidate wallet into a single key")
+	fmt.Println("  pay       - perform a payment to another peer")
+	fmt.Println("              (or pay <address> <amount> [fee] to pay anyone)")
+	fmt.Println("  paymany   - pay many addresses or peers in one transaction")
+	fmt.Println("              (paymany <to> <amount> ... [fee], or paymany -f <file.csv> [fee])")
+	fmt.Println("  receive   - generate a new address to be paid at")
+	fmt.Println("  watch     - follow addresses without their keys (watch <address or public key> ...)")
+	fmt.Println("  unwatch   - stop following an address (unwatch <address>)")
+	fmt.Println("  txn       - pay from watched addresses, signing elsewhere (txn create|sign|broadcast <file> ...)")
+	fmt.Println("  coins     - show or set how coins are chosen to pay with (coins [strategy])")
+	fmt.Println("  bump      - pay a higher fee on a pending payment (bump <txid>)")
 	fmt.Println()
-	fmt.Println("  addr   - print the listening address of this peer")
-	fmt.Println("  help   - display this help")
-	fmt.Println("  quit   - shut down gocoin (your wallet will be lost)")
+	fmt.Println("  addr      - print the listening address of this peer")
+	fmt.Println("  peers     - list connected and known peers, with latency")
+	fmt.Println("  help      - display this help")
+	fmt.Println("  quit      - shut down gocoin (your wallet will be lost, unless it has a seed)")
 	fmt.Println()
 }
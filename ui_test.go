@@ -0,0 +1,37 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPaymentTotal(t *testing.T) {
+	coins := []Coin{{testAddress(1), 10}, {testAddress(2), 5}}
+	pay := func(amounts ...uint64) []TxnOutput {
+		var payments []TxnOutput
+		for i, amount := range amounts {
+			payments = append(payments, TxnOutput{testAddress(byte(i)), amount})
+		}
+		return payments
+	}
+
+	tests := []struct {
+		name     string
+		payments []TxnOutput
+		fee      uint64
+		total    uint64
+		ok       bool
+	}{
+		{"everything", pay(10, 4), 1, 14, true},
+		{"too much", pay(10, 5), 1, 15, false},
+		{"amount plus fee overflows", pay(math.MaxUint64), 2, 0, false},
+		{"amounts overflow", pay(math.MaxUint64, 6), 0, 0, false},
+	}
+
+	for _, test := range tests {
+		total, ok := paymentTotal(test.payments, test.fee, coins)
+		if ok != test.ok || (ok && total != test.total) {
+			t.Errorf("%s: got %d, %v; want %d, %v", test.name, total, ok, test.total, test.ok)
+		}
+	}
+}
@@ -1,19 +1,16 @@
 package main
 
-import (
-	"crypto/rand"
-	"crypto/rsa"
-)
+// an io.Writer that just counts what's written to it
+type byteCounter int
 
-func genKey() *rsa.PrivateKey {
-	key, err := rsa.GenerateKey(rand.Reader, 1024)
-	if err != nil {
-		panic(err)
-	}
-
-	return key
+func (c *byteCounter) Write(b []byte) (int, error) {
+	*c += byteCounter(len(b))
+	return len(b), nil
 }
 
-func keysEql(a, b *rsa.PublicKey) bool {
-	return a.N.Cmp(b.N) == 0 && a.E == b.E
+// returns a + b, and false if that overflows (as it can for amounts given by
+// a peer)
+func addAmounts(a, b uint64) (uint64, bool) {
+	sum := a + b
+	return sum, sum >= a
 }